@@ -1,8 +1,8 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
-	"sort"
 	"strconv"
 	"strings"
 
@@ -12,44 +12,84 @@ import (
 	"golang.org/x/text/language"
 )
 
-func ShowContestsByCard(b *BallotData) {
-	contestIDs := make([]int, len(b.Raw.Contests))
+// CardsResult is which contests appear together on cards.
+type CardsResult struct {
+	resultHeader
+	// in the order of the export
+	Contests []ContestInfo `json:"contests"`
+	Layouts  []CardLayout  `json:"layouts"`
+}
+
+// CardLayout is a set of contests that appear together on some cards.
+type CardLayout struct {
+	ContestIDs []int `json:"contestIds"`
+	Cards      int   `json:"cards"`
+}
+
+func ContestsByCard(b *BallotData) *CardsResult {
+	ret := &CardsResult{resultHeader: resultHeader{Type: "cards"}}
 	contestIndexes := make(map[int]int, len(b.Raw.Contests))
 	for i, contest := range b.Raw.Contests {
-		contestIDs[i] = contest.ID
+		ret.Contests = append(ret.Contests, contestInfo(b, contest.ID))
 		contestIndexes[contest.ID] = i
 	}
 
 	counts := map[string]int{}
 	sig := make([]byte, len(contestIndexes))
-	for _, card := range b.Cards {
-		for i := range sig {
-			sig[i] = ' '
+	b.forEachBallot(func(ballot *Ballot) {
+		for _, card := range ballot.Cards {
+			for i := range sig {
+				sig[i] = ' '
+			}
+			for _, contest := range card.Contests {
+				sig[contestIndexes[contest.ID]] = 'X'
+			}
+			counts[string(sig)] += 1
 		}
-		for _, contest := range card.Contests {
-			sig[contestIndexes[contest.ID]] = 'X'
+	})
+
+	sigs := maps.Keys(counts)
+	slices.Sort(sigs)
+	for _, sig := range sigs {
+		layout := CardLayout{ContestIDs: []int{}, Cards: counts[sig]}
+		for i, c := range sig {
+			if c == 'X' {
+				layout.ContestIDs = append(layout.ContestIDs, b.Raw.Contests[i].ID)
+			}
 		}
-		counts[string(sig)] += 1
+		ret.Layouts = append(ret.Layouts, layout)
 	}
+	return ret
+}
 
+func (r *CardsResult) Text() string {
+	contestIDs := map1(func(contest ContestInfo) int { return contest.ID }, r.Contests)
+
+	var buf strings.Builder
 	digits := len(strconv.Itoa(max(contestIDs...)))
 	for i := 0; i < digits; i++ {
 		for _, id := range contestIDs {
-			fmt.Printf(fmt.Sprintf("%0"+strconv.Itoa(digits)+"d", id)[i : i+1])
+			buf.WriteString(fmt.Sprintf("%0"+strconv.Itoa(digits)+"d", id)[i : i+1])
 		}
-		fmt.Println()
+		buf.WriteString("\n")
 	}
 
-	for k, v := range counts {
-		fmt.Println(k, v)
+	for _, layout := range r.Layouts {
+		sig := []byte(strings.Repeat(" ", len(contestIDs)))
+		for _, id := range layout.ContestIDs {
+			sig[slices.Index(contestIDs, id)] = 'X'
+		}
+		fmt.Fprintln(&buf, string(sig), layout.Cards)
 	}
-	fmt.Println()
+	buf.WriteString("\n")
+	return buf.String()
 }
 
 const (
 	abstain   = "Abstain"
 	invalid   = "Invalid"
 	exhausted = "Exhausted"
+	overvoted = "Overvote"
 )
 
 func shortName(name string) string {
@@ -101,15 +141,26 @@ func candidates(b *BallotData, contestID int) (map[int]string, error) {
 	return ret, nil
 }
 
-func scoreContest(contest *RawCardContest, candidates map[int]string) (string, error) {
+// fullNames returns the candidates' names as they appear on the ballot.
+func fullNames(b *BallotData, contestID int) map[int]string {
+	ret := map[int]string{}
+	for _, cand := range b.CandidatesByContest[contestID] {
+		ret[cand.ID] = cand.Description
+	}
+	return ret
+}
+
+// scoreContest returns the candidate a plurality contest is a vote for, and
+// their name, or 0 and Abstain or Invalid.
+func scoreContest(contest *RawCardContest, candidates map[int]string) (int, string, error) {
 	switch {
 	case contest.Undervotes > 0:
-		return abstain, nil
+		return 0, abstain, nil
 	case contest.Overvotes > 0 || len(contest.OutstackConditionIDs) > 0:
-		return invalid, nil
+		return 0, invalid, nil
 	}
 
-	ret := invalid
+	id, ret := 0, invalid
 	marks := 0
 	for _, mark := range contest.Marks {
 		if !mark.IsVote {
@@ -117,52 +168,304 @@ func scoreContest(contest *RawCardContest, candidates map[int]string) (string, e
 		}
 		marks++
 		var ok bool
-		ret, ok = candidates[mark.CandidateID]
+		id = mark.CandidateID
+		ret, ok = candidates[id]
 		if !ok {
-			return invalid, fmt.Errorf("unexpected candidate: %v", mark.CandidateID)
+			return 0, invalid, fmt.Errorf("unexpected candidate: %v", mark.CandidateID)
 		}
 	}
 	if marks != 1 {
-		return invalid, fmt.Errorf("undetected under/overvote: %v", contest.Marks)
+		return 0, invalid, fmt.Errorf("undetected under/overvote: %v", contest.Marks)
 	}
-	return ret, nil
+	return id, ret, nil
+}
+
+// ContestResult is the result of a plurality contest.
+type ContestResult struct {
+	resultHeader
+	Contest ContestInfo `json:"contest"`
+	// votes for each candidate, and ballots that abstained or voted invalidly
+	Results []Tally `json:"results"`
+	Ballots int     `json:"ballots"`
+
+	results map[string]int
+}
+
+func AnalyzeContest(b *BallotData, contestID int) *ContestResult {
+	// NOTE: results here differ slightly from published results; seemingly for
+	// ballots that get manually audited that doesn't make it back into the
+	// dataset.
+	names := contestCandidateNames(b, contestID)
+	column := b.contestColumns(contestID)[0]
+	results := column.counts()
+
+	return &ContestResult{
+		resultHeader: resultHeader{Type: "plurality"},
+		Contest:      contestInfo(b, contestID),
+		Results:      names.tallies(column.votes(), " + "),
+		Ballots:      sum(maps.Values(results)),
+		results:      results,
+	}
+}
+
+func (r *ContestResult) Text() string {
+	return r.Contest.Description + "\n" + formatResults(r.results) + "\n"
+}
+
+func scoreVoteForNContest(contest *RawCardContest, candidates map[int]string, voteFor int) ([]int, string, error) {
+	// Undervotes here counts the unused votes, so a partial undervote is still
+	// a valid vote for fewer candidates; we handle it below. We ignore outstack
+	// condition IDs for the same reason as in scoreRCVContest.
+	if contest.Overvotes > 0 {
+		return nil, invalid, nil
+	}
+
+	var selected []int
+	for _, mark := range contest.Marks {
+		if !mark.IsVote {
+			continue
+		}
+		if _, ok := candidates[mark.CandidateID]; !ok {
+			return nil, invalid, fmt.Errorf("unexpected candidate: %v", mark.CandidateID)
+		}
+		if slices.Contains(selected, mark.CandidateID) {
+			continue
+		}
+		selected = append(selected, mark.CandidateID)
+	}
+	switch {
+	case len(selected) == 0:
+		return nil, abstain, nil
+	case len(selected) > voteFor:
+		return nil, invalid, fmt.Errorf("undetected overvote: %v", contest.Marks)
+	}
+
+	names := make([]string, len(selected))
+	for i, id := range selected {
+		names[i] = candidates[id]
+	}
+	slices.Sort(names)
+	return selected, strings.Join(names, " + "), nil
+}
+
+func voteForNSelections(b *BallotData, contestID int, cands map[int]string) ([][]int, map[string]int) {
+	contestInfo := b.Contests[contestID]
+
+	stringResults := map[string]int{}
+	var selections [][]int
+	b.forEachBallot(func(ballot *Ballot) {
+		for _, card := range ballot.Cards {
+			for _, contest := range card.Contests {
+				if contest.ID != contestID {
+					continue
+				}
+
+				selected, voteStr, err := scoreVoteForNContest(contest, cands, contestInfo.VoteFor)
+				if err != nil {
+					panic(err)
+				}
+				if voteStr != invalid {
+					selections = append(selections, selected)
+				}
+				stringResults[voteStr]++
+			}
+		}
+	})
+	return selections, stringResults
+}
+
+// VoteForNResult is the result of a contest where voters may vote for more
+// than one candidate.
+type VoteForNResult struct {
+	resultHeader
+	Contest ContestInfo `json:"contest"`
+	Valid   int         `json:"valid"`
+	Abstain int         `json:"abstain"`
+	Invalid int         `json:"invalid"`
+	// votes for each candidate
+	Votes []CandidateCount `json:"votes"`
+	// ballots, but not invalid ones, by how many candidates they vote for,
+	// from 0 to VoteFor
+	ByCount []int `json:"byCount"`
+	// ballots that vote only for each candidate
+	BulletVotes []CandidateCount `json:"bulletVotes"`
+	// ballots for each set of VoteFor candidates, most common first
+	FullSlates []Tally `json:"fullSlates"`
 }
 
-func ShowContest(b *BallotData, contestID int) {
+func AnalyzeVoteForNContest(b *BallotData, contestID int) *VoteForNResult {
 	// NOTE: results here differ slightly from published results; seemingly for
 	// ballots that get manually audited that doesn't make it back into the
 	// dataset.
+	voteFor := b.Contests[contestID].VoteFor
+	names := contestCandidateNames(b, contestID)
+	selections, stringResults := voteForNSelections(b, contestID, names.short)
+
+	ret := &VoteForNResult{
+		resultHeader: resultHeader{Type: "voteForN"},
+		Contest:      contestInfo(b, contestID),
+		Valid:        len(selections) - stringResults[abstain],
+		Abstain:      stringResults[abstain],
+		Invalid:      stringResults[invalid],
+		ByCount:      make([]int, voteFor+1),
+	}
+
+	votes := map[int]int{}
+	singles := map[int]int{}
+	for _, selected := range selections {
+		ret.ByCount[len(selected)]++
+		for _, id := range selected {
+			votes[id]++
+		}
+		if len(selected) == 1 {
+			singles[selected[0]]++
+		}
+	}
+	ret.Votes = names.counts(votes)
+	ret.BulletVotes = names.counts(singles)
+
+	var slates voteCounter
+	for _, selected := range selections {
+		if len(selected) == voteFor {
+			slates.add(sortedCandidates(onlyCandidates(names.short, selected)), "")
+		}
+	}
+	ret.FullSlates = names.tallies(slates.votes, " + ")
+	slices.SortStableFunc(ret.FullSlates, func(x, y Tally) bool { return x.Count > y.Count })
+	return ret
+}
+
+func (r *VoteForNResult) Text() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%v (vote for %v)\n", r.Contest.Description, r.Contest.VoteFor)
+	buf.WriteString(formatResults(map[string]int{
+		"Valid": r.Valid,
+		abstain: r.Abstain,
+		invalid: r.Invalid,
+	}))
+	buf.WriteString("\n")
+
+	buf.WriteString("Ballot summary\n")
+	totals := map[string]int{}
+	for _, votes := range r.Votes {
+		if votes.Count > 0 {
+			totals[votes.Name] = votes.Count
+		}
+	}
+	buf.WriteString(formatResults(totals))
+	buf.WriteString("\n")
+	for i, n := range r.ByCount {
+		fmt.Fprintf(&buf, "%v candidates: %v\n", i, n)
+	}
+	buf.WriteString("\n")
+	for i, bullets := range r.BulletVotes {
+		fmt.Fprintf(&buf, "%v: %v bullet votes (%.1f%% of their votes)\n",
+			bullets.Name, bullets.Count, 100*float64(bullets.Count)/float64(max(r.Votes[i].Count, 1)))
+	}
+	buf.WriteString("\n")
+
+	buf.WriteString("Most common full slates\n")
+	slates := map[string]int{}
+	for _, slate := range r.FullSlates {
+		slates[slate.Result] += slate.Count
+	}
+	buf.WriteString(formatTopResults(slates, 20))
+	buf.WriteString("\n")
+	return buf.String()
+}
+
+// CoVoteGrids returns, for a vote-for-N contest, the number of each
+// candidate's (row) voters who also voted for each other candidate (column),
+// and the same as a share of the row candidate's voters.
+func CoVoteGrids(b *BallotData, contestID int) (counts, shares [][]any) {
+	contestInfo := b.Contests[contestID]
+
 	cands, err := candidates(b, contestID)
 	if err != nil {
 		panic(err)
 	}
+	ids := sortedCandidates(cands)
+	index := make(map[int]int, len(ids))
+	for i, id := range ids {
+		index[id] = i
+	}
 
-	results := map[string]int{}
-	for _, card := range b.Cards {
-		for _, contest := range card.Contests {
-			if contest.ID != contestID {
-				continue
-			}
-
-			vote, err := scoreContest(contest, cands)
-			if err != nil {
-				panic(err)
+	selections, _ := voteForNSelections(b, contestID, cands)
+	n := len(ids)
+	coVotes := make([][]int, n)
+	for i := range coVotes {
+		coVotes[i] = make([]int, n)
+	}
+	for _, selected := range selections {
+		for _, id1 := range selected {
+			for _, id2 := range selected {
+				coVotes[index[id1]][index[id2]]++
 			}
-			results[vote]++
 		}
 	}
 
-	fmt.Println(b.Contests[contestID].Description)
-	fmt.Print(formatResults(results))
-	fmt.Println()
+	counts = candidateGrid(contestInfo.Description, ids, cands, func(i, j int) any {
+		// the diagonal is just the candidate's total
+		return coVotes[index[i]][index[j]]
+	})
+	shares = candidateGrid(contestInfo.Description, ids, cands, func(i, j int) any {
+		if i == j {
+			return nil
+		}
+		return float64(coVotes[index[i]][index[j]]) / float64(max(coVotes[index[i]][index[i]], 1))
+	})
+	return counts, shares
+}
+
+type overvotePolicy int
+
+const (
+	// An overvote exhausts the ballot, keeping only the ranks before it.
+	overvoteExhaust overvotePolicy = iota
+	// An overvoted rank is skipped as if it were blank.
+	overvoteSkip
+)
+
+type duplicatePolicy int
+
+const (
+	// Later rankings of an already-ranked candidate are skipped.
+	duplicateSkip duplicatePolicy = iota
+	// A repeated candidate exhausts the ballot, keeping only the ranks before.
+	duplicateExhaust
+)
+
+// rcvBallotRules describe how to interpret the marks on a ranked ballot.
+type rcvBallotRules struct {
+	// Exhaust the ballot once it skips this many consecutive ranks, keeping
+	// only the ranks before; 0 to ignore skipped ranks entirely.
+	maxSkippedRanks int
+	overvote        overvotePolicy
+	duplicate       duplicatePolicy
+	// Count marks the scanner flagged as ambiguous.
+	countAmbiguous bool
+}
+
+var rcvBallotRulesPresets = map[string]rcvBallotRules{
+	// S.F. Charter §13.102: skipped ranks are ignored, and an overvote
+	// exhausts the ballot.
+	"sf": {},
+	// Alaska Stat. §15.15.350(c)–(e): two consecutive skipped ranks also
+	// exhaust the ballot.
+	"alaska": {maxSkippedRanks: 2},
+	// Maine RCV rules, 29-250 C.M.R. ch. 535 §4: as in Alaska.
+	"maine": {maxSkippedRanks: 2},
+	// N.Y.C. Charter §1057-g: the same as in SF, though spelled out
+	// separately.
+	"nyc": {},
 }
 
-func scoreRCVContest(contest *RawCardContest, candidates map[int]string, ranks int) ([]int, string, error) {
+func scoreRCVContest(contest *RawCardContest, candidates map[int]string, ranks int, rules rcvBallotRules) (rcvBallot, string, error) {
 	switch {
 	// Undervote here seems to mean "no first choice", which may still be a
 	// valid vote, so ignore it (and handle below).
-	case contest.Overvotes > 0:
-		return nil, invalid, nil
+	case contest.Overvotes > 0 && rules.overvote == overvoteExhaust:
+		return rcvBallot{overvoted: true}, invalid, nil
 		// we ignore outstack condition IDs because UnusedRanking is fine.
 	}
 
@@ -171,14 +474,14 @@ func scoreRCVContest(contest *RawCardContest, candidates map[int]string, ranks i
 		votedRanks[i] = -1
 	}
 	for _, mark := range contest.Marks {
-		if mark.IsAmbiguous {
+		if mark.IsAmbiguous && !rules.countAmbiguous {
 			continue
 		}
 		if votedRanks[mark.Rank-1] == -1 {
 			votedRanks[mark.Rank-1] = mark.CandidateID
 		} else {
-			// voted for two candidates at the same rank, we will discard this
-			// and lower ranks below
+			// voted for two candidates at the same rank, we will handle this
+			// per rules.overvote below
 			votedRanks[mark.Rank-1] = -2
 		}
 	}
@@ -188,18 +491,38 @@ func scoreRCVContest(contest *RawCardContest, candidates map[int]string, ranks i
 	// voter already voted for this candidate. If two candidates have the same
 	// rank, bail, but don't discard higher ranks.
 	// So ABCD → ABCD, ABAB → AB, A__B → AB, AB(CD)E → AB, etc.
+	// The rules may instead bail after too many empty ranks, or on a repeated
+	// candidate, or skip a rank with two candidates.
 	tabulatedRanks := make([]int, 0, ranks)
 	seen := make(map[int]bool, ranks)
+	overvote := false
+	skipped := 0
+loop:
 	for _, cand := range votedRanks {
-		if cand == -2 {
+		switch {
+		case cand == -1:
+			skipped++
+			continue
+		case rules.maxSkippedRanks > 0 && skipped >= rules.maxSkippedRanks:
+			// too many empty ranks, discard this and later ranks.
+			break loop
+		}
+		skipped = 0
+
+		switch {
+		case cand == -2 && rules.overvote == overvoteSkip:
+			continue
+		case cand == -2:
 			// two at the same rank, discard this and later ranks.
 			if len(tabulatedRanks) == 0 {
 				// if this was the only rank, it's an overvote.
-				return nil, invalid, nil
+				return rcvBallot{overvoted: true}, invalid, nil
 			}
-			break
-		}
-		if cand < 0 || seen[cand] {
+			overvote = true
+			break loop
+		case seen[cand] && rules.duplicate == duplicateExhaust:
+			break loop
+		case seen[cand]:
 			// no valid vote at this rank, but we continue on
 			continue
 		}
@@ -208,295 +531,402 @@ func scoreRCVContest(contest *RawCardContest, candidates map[int]string, ranks i
 	}
 
 	if len(tabulatedRanks) == 0 {
-		return nil, abstain, nil
+		return rcvBallot{}, abstain, nil
 	}
 
 	names := make([]string, len(tabulatedRanks))
 	for i, id := range tabulatedRanks {
 		name, ok := candidates[id]
 		if !ok {
-			return nil, invalid, fmt.Errorf("unexpected candidate: %v", id)
+			return rcvBallot{}, invalid, fmt.Errorf("unexpected candidate: %v", id)
 		}
 		names[i] = name
 	}
-	return tabulatedRanks, strings.Join(names, " > "), nil
+	return rcvBallot{tabulatedRanks, overvote}, strings.Join(names, " > "), nil
+}
+
+func borda(numRanks int) func(int) int {
+	return func(rank int) int { return numRanks - rank }
 }
 
-func rcvBallotSummary(ranks [][]int, candidates map[int]string) string {
-	counts := map[int]int{}  // number of candidates -> count
-	singles := map[int]int{} // candidate ID -> count
-	firsts := map[int]int{}  // candidate ID -> count
+var dowdall = func(rank int) float64 { return 1 / (float64(rank) + 1) }
 
+func runPositional[T numeric](ranks [][]int, value func(int) T) map[int]T {
+	totals := map[int]T{}
 	for _, ranking := range ranks {
-		counts[len(ranking)]++
-		if len(ranking) == 0 {
-			continue
-		}
-		firsts[ranking[0]]++
-		if len(ranking) == 1 {
-			singles[ranking[0]]++
+		for i, rank := range ranking {
+			totals[rank] += value(i)
 		}
 	}
+	return totals
+}
 
-	var buf strings.Builder
-	for i := 0; i <= len(candidates); i++ {
-		if counts[i] > 0 {
-			fmt.Fprintf(&buf, "%v candidates: %v\n", i, counts[i])
-		}
-	}
+// byShortName converts totals by candidate ID to totals by name, for
+// formatResults.
+func byShortName[T numeric](totals map[int]T, candidates map[int]string) map[string]T {
+	ret := make(map[string]T, len(candidates))
 	for id, name := range candidates {
-		fmt.Fprintf(&buf, "%v: %v only, %v first\n", name, singles[id], firsts[id])
+		ret[name] += totals[id]
 	}
-	return buf.String()
+	return ret
 }
 
-type irvRoundResults struct {
-	topChoices map[string]int
-	eliminated string
+type rcvOptions struct {
+	ballot rcvBallotRules
+	irv    irvRules
+	stv    stvOptions
+	// rerun with each candidate withdrawn in turn
+	spoilers bool
+	// rerun with these candidates withdrawn together
+	withdraw []int
 }
 
-func runIRV(ranks [][]int, candidates map[int]string) []irvRoundResults {
-	var results []irvRoundResults
-	eliminated := map[string]bool{}
-
-	for {
-		topChoices := map[string]int{}
-		for _, ranking := range ranks {
-			top := exhausted
-			for _, rank := range ranking {
-				if !eliminated[candidates[rank]] {
-					top = candidates[rank]
-					break
-				}
-			}
-			topChoices[top]++
-		}
+// rcvContestBallots scores the ballots in a ranked contest, returning them as
+// they will be tabulated, and as marked.
+func rcvContestBallots(b *BallotData, contestID int, rules rcvBallotRules) (rankedContest, []rcvBallot, map[string]int) {
+	contestInfo := b.Contests[contestID]
 
-		total := 0
-		worst := -1
-		worstName := ""
-		for name, votes := range topChoices {
-			total += votes
-			if name != exhausted && (worst == -1 || votes < worst) {
-				worst = votes
-				worstName = name
-			}
-		}
-		eliminated[worstName] = true
-		results = append(results, irvRoundResults{topChoices, worstName})
+	cands, err := candidates(b, contestID)
+	if err != nil {
+		panic(err)
+	}
+	column := b.rankedColumn(contestID, rules)
+
+	return rankedContest{
+		name:        strconv.Itoa(contestID),
+		description: contestInfo.Description,
+		numRanks:    contestInfo.NumOfRanks,
+		candidates:  cands,
+		fullNames:   fullNames(b, contestID),
+	}, column.ballots(), maps.Clone(column.results)
+}
 
-		if len(topChoices) <= 2 { // winner + exhausted
-			return results
+func AnalyzeRCVContest(b *BallotData, contestID int, opts rcvOptions) *RCVResult {
+	// NOTE: results here differ slightly from published results; seemingly for
+	// ballots that get manually audited that doesn't make it back into the
+	// dataset.
+	contest, ballots, stringResults := rcvContestBallots(b, contestID, opts.ballot)
+
+	ret := analyzeRankedBallots(contest, ballots, nil, opts)
+	ret.Contest.ID = contestID
+	ret.Contest.VoteFor = b.Contests[contestID].VoteFor
+	var votes voteCounter
+	for _, ballot := range ballots {
+		switch {
+		case len(ballot.ranks) > 0:
+			votes.add(ballot.ranks, "")
+		case ballot.overvoted:
+			votes.add(nil, invalid)
+		default:
+			votes.add(nil, abstain)
 		}
 	}
+	ret.Results = candidateNames{contest.candidates, contest.fullNames}.tallies(votes.votes, " > ")
+	ret.heading = fmt.Sprintf("%v (RCV, rank up to %v)\n", contest.description, contest.numRanks) +
+		formatResults(stringResults) + "\n"
+	return ret
 }
 
-func borda(numRanks int) func(int) int {
-	return func(rank int) int { return numRanks - rank }
+// rankedContest is what we need to know about a ranked contest, besides the
+// ballots, to analyze it.
+type rankedContest struct {
+	name        string // for output filenames
+	description string
+	numRanks    int
+	candidates  map[int]string
+	fullNames   map[int]string
 }
 
-var dowdall = func(rank int) float64 { return 1 / (float64(rank) + 1) }
-
-func runPositional[T numeric](ranks [][]int, candidates map[int]string, value func(int) T) map[string]T {
-	totals := map[string]T{}
-	for _, ranking := range ranks {
-		for i, rank := range ranking {
-			totals[candidates[rank]] += value(i)
-		}
-	}
-	return totals
+// RCVResult is the result of a ranked contest, tabulated every way we know.
+type RCVResult struct {
+	resultHeader
+	Contest ContestInfo `json:"contest"`
+	// ballots by how they are marked, as they will be tabulated: the
+	// candidates' names joined by " > ", or Abstain or Invalid; omitted for
+	// ballots read from a file
+	Results []Tally `json:"results,omitempty"`
+	Ballots int     `json:"ballots"`
+	// ballots by how many candidates they rank, from 0
+	ByLength     []int            `json:"byLength"`
+	FirstChoices []CandidateCount `json:"firstChoices"`
+	// ballots that rank only each candidate
+	OnlyChoices []CandidateCount `json:"onlyChoices"`
+	IRV         IRVResult        `json:"irv"`
+	STV         *STVResult       `json:"stv,omitempty"`
+	Borda       []CandidateScore `json:"borda"`
+	Dowdall     []CandidateScore `json:"dowdall"`
+	// with -spoilers or -withdraw
+	Spoilers    []SpoilerScenario `json:"spoilers,omitempty"`
+	Condorcet   CondorcetResult   `json:"condorcet"`
+	Preferences []Preference      `json:"preferences"`
+	// rankings, best first, as tiers of tied candidates
+	Schulze     [][]CandidateInfo `json:"schulze"`
+	RankedPairs [][]CandidateInfo `json:"rankedPairs"`
+	Minimax     [][]CandidateInfo `json:"minimax"`
+	Copeland    [][]CandidateInfo `json:"copeland"`
+	// null if there are too many candidates to try every ordering
+	KemenyYoung [][]CandidateInfo `json:"kemenyYoung"`
+	// the number of orderings tied for best
+	KemenyYoungOptimal int `json:"kemenyYoungOptimal,omitempty"`
+
+	heading string
+	contest rankedContest
+	ballots []rcvBallot
+	irv     []irvRoundResults
+	margin  irvMargin
+	stv     []stvRoundResults
+	borda   map[int]int
+	dowdall map[int]float64
+	p       pairwise
+	paths   map[[2]int]int
+	schulze ranking
+	// other Condorcet methods
+	rankedPairs ranking
+	minimax     ranking
+	copeland    ranking
+	kemeny      ranking
+	kemenyN     int
 }
 
-func convertCondorcetMap(m map[[2]int]int, candidates map[int]string) map[string]int {
-	ret := make(map[string]int, len(m))
-	for k, v := range m {
-		ret[fmt.Sprintf("%v > %v", candidates[k[0]], candidates[k[1]])] = v
+// analyzeRankedBallots analyzes a ranked contest. If the ballots were rounded
+// from fractional weights, weighted has the exact ones, for STV; otherwise
+// it's nil.
+func analyzeRankedBallots(contest rankedContest, ballots []rcvBallot, weighted []*stvBallot, opts rcvOptions) *RCVResult {
+	cands := contest.candidates
+	names := candidateNames{cands, contest.fullNames}
+	rankResults := rankings(ballots)
+
+	ret := &RCVResult{
+		resultHeader: resultHeader{Type: "rcv"},
+		Contest:      names.contest(0, contest.description, 0, contest.numRanks),
+		Ballots:      len(ballots),
+		ByLength:     make([]int, len(cands)+1),
+		contest:      contest,
+		ballots:      ballots,
 	}
-	return ret
-}
 
-// returns paths iff winner is not condorcet
-func runSchulze(ranks [][]int, candidates map[int]string) (winner string, prefs, paths map[string]int) {
-	candsMap := map[int]bool{}
-	for _, ranking := range ranks {
-		for _, rank := range ranking {
-			candsMap[rank] = true
-		}
-	}
-	prefsMap := map[[2]int]int{}
-	for _, ranking := range ranks {
-		seen := map[int]bool{}
-		for i, rank := range ranking {
-			seen[rank] = true
-			for _, otherRank := range ranking[i+1:] {
-				prefsMap[[2]int{rank, otherRank}] += 1
-			}
+	firsts := map[int]int{}
+	singles := map[int]int{}
+	for _, ranking := range rankResults {
+		ret.ByLength[len(ranking)]++
+		if len(ranking) == 0 {
+			continue
 		}
-		for cand := range candsMap {
-			if !seen[cand] {
-				// unranked candidates go after all ranked candidates
-				for _, rank := range ranking {
-					prefsMap[[2]int{rank, cand}] += 1
-				}
-			}
+		firsts[ranking[0]]++
+		if len(ranking) == 1 {
+			singles[ranking[0]]++
 		}
 	}
-	cands := maps.Keys(candsMap)
-	sort.Ints(cands)
+	ret.FirstChoices = names.counts(firsts)
+	ret.OnlyChoices = names.counts(singles)
 
-	for _, c1 := range cands {
-		winner := true
-		for _, c2 := range cands {
-			if c1 != c2 && prefsMap[[2]int{c1, c2}] <= prefsMap[[2]int{c2, c1}] {
-				winner = false
-			}
+	ret.irv = runIRV(ballots, cands, opts.irv)
+	ret.margin = irvMarginBounds(ballots, cands, ret.irv, opts.irv)
+	ret.IRV = irvResult(ret.irv, ret.margin, names)
+
+	if opts.stv.seats > 0 {
+		var err error
+		if weighted == nil {
+			weighted = groupRankings(rankResults)
 		}
-		if winner {
-			return candidates[c1], convertCondorcetMap(prefsMap, candidates), nil
+		ret.stv, err = runSTV(weighted, cands, opts.stv)
+		if err != nil {
+			panic(fmt.Errorf("%v: %w", contest.description, err))
 		}
+		ret.STV = stvResult(ret.stv, opts.stv, names)
 	}
 
-	pathsMap := map[[2]int]int{}
-	// https://en.wikipedia.org/wiki/Schulze_method#Implementation
-	// d is prefsMap, p is pathsMap, 1..C is cands.
-	for _, c1 := range cands {
-		for _, c2 := range cands {
-			if c1 == c2 {
-				continue
-			}
+	ret.borda = runPositional(rankResults, borda(contest.numRanks))
+	ret.Borda = scores(names, ret.borda)
+	ret.dowdall = runPositional(rankResults, dowdall)
+	ret.Dowdall = scores(names, ret.dowdall)
 
-			if prefsMap[[2]int{c1, c2}] > prefsMap[[2]int{c2, c1}] {
-				pathsMap[[2]int{c1, c2}] = prefsMap[[2]int{c1, c2}]
-			} else {
-				pathsMap[[2]int{c1, c2}] = 0
-			}
-		}
+	if opts.spoilers || len(opts.withdraw) > 0 {
+		ret.Spoilers = spoilerScenarios(ballots, names, contest.numRanks, opts)
 	}
 
-	for _, c1 := range cands {
-		for _, c2 := range cands {
-			if c1 == c2 {
-				continue
-			}
-			for _, c3 := range cands {
-				if c1 == c3 || c2 == c3 {
-					continue
-				}
-				pathsMap[[2]int{c2, c3}] = max(
-					pathsMap[[2]int{c2, c3}],
-					min(pathsMap[[2]int{c2, c1}], pathsMap[[2]int{c1, c3}]))
-			}
-		}
+	ret.p = pairwisePreferences(rankResults, cands)
+	ret.Condorcet = condorcetResult(ret.p, names)
+	ret.schulze, ret.paths = runSchulze(ret.p)
+	ret.Schulze = names.ranking(ret.schulze)
+	ret.Preferences = preferences(ret.p, ret.paths, names)
+
+	ret.rankedPairs = runRankedPairs(ret.p)
+	ret.RankedPairs = names.ranking(ret.rankedPairs)
+	ret.minimax = runMinimax(ret.p)
+	ret.Minimax = names.ranking(ret.minimax)
+	ret.copeland = runCopeland(ret.p)
+	ret.Copeland = names.ranking(ret.copeland)
+	ret.kemeny, ret.kemenyN = runKemenyYoung(ret.p)
+	ret.KemenyYoung = names.ranking(ret.kemeny)
+	if ret.kemeny != nil {
+		ret.KemenyYoungOptimal = ret.kemenyN
 	}
+	return ret
+}
 
-	for _, c1 := range cands {
-		winner := true
-		for _, c2 := range cands {
-			if c1 != c2 && pathsMap[[2]int{c1, c2}] <= pathsMap[[2]int{c2, c1}] {
-				winner = false
-			}
-		}
-		if winner {
-			return candidates[c1],
-				convertCondorcetMap(prefsMap, candidates),
-				convertCondorcetMap(pathsMap, candidates)
+func (r *RCVResult) Text() string {
+	cands := r.contest.candidates
+	var buf strings.Builder
+	buf.WriteString(r.heading)
+
+	buf.WriteString("Ballot summary\n")
+	for i, n := range r.ByLength {
+		if n > 0 {
+			fmt.Fprintf(&buf, "%v candidates: %v\n", i, n)
 		}
 	}
-	panic(fmt.Sprintf("no schulze winner %v %v", prefsMap, pathsMap))
-}
+	for i, firsts := range r.FirstChoices {
+		fmt.Fprintf(&buf, "%v: %v only, %v first\n", firsts.Name, r.OnlyChoices[i].Count, firsts.Count)
+	}
+	buf.WriteString("\n")
 
-func ShowRCVContest(b *BallotData, contestID int) {
-	// NOTE: results here differ slightly from published results; seemingly for
-	// ballots that get manually audited that doesn't make it back into the
-	// dataset.
-	contestInfo := b.Contests[contestID]
+	for i, round := range r.irv {
+		fmt.Fprintf(&buf, "IRV Round %v\n", i+1)
+		buf.WriteString(formatIRVRound(round, cands))
+		buf.WriteString("\n")
+	}
+	if len(r.irv) == 0 {
+		buf.WriteString("IRV: no ballots count for any candidate\n")
+	} else {
+		buf.WriteString(formatIRVMargin(r.margin, cands))
+	}
+	buf.WriteString("\n")
 
-	cands, err := candidates(b, contestID)
-	if err != nil {
-		panic(err)
+	if r.STV != nil {
+		fmt.Fprintf(&buf, "STV for %v seats (%v quota, %v surplus transfer)\n",
+			r.STV.Seats, r.STV.Quota, r.STV.Transfer)
+		buf.WriteString(formatTable(stvTable(r.stv, cands)))
+		buf.WriteString("\n")
 	}
 
-	stringResults := map[string]int{}
-	var rankResults [][]int
-	for _, card := range b.Cards {
-		for _, contest := range card.Contests {
-			if contest.ID != contestID {
-				continue
-			}
+	buf.WriteString("Borda count\n")
+	buf.WriteString(formatResults(byShortName(r.borda, cands)))
+	buf.WriteString("\n")
+
+	buf.WriteString("Nauru/Dowdall method\n")
+	buf.WriteString(formatResults(byShortName(r.dowdall, cands)))
+	buf.WriteString("\n")
 
-			ranks, voteStr, err := scoreRCVContest(contest, cands, contestInfo.NumOfRanks)
+	if len(r.Spoilers) > 0 {
+		buf.WriteString("Winners with candidates withdrawn (* if changed)\n")
+		buf.WriteString(formatTable(spoilerTable(r.Spoilers)))
+		buf.WriteString("\n")
+	}
+
+	buf.WriteString("Condorcet analysis\n")
+	irvWinner := 0
+	if r.IRV.Winner != nil {
+		irvWinner = r.IRV.Winner.ID
+	}
+	buf.WriteString(formatCondorcetReport(r.p, cands, irvWinner))
+	buf.WriteString("\n")
+
+	buf.WriteString("Schulze method\n")
+	buf.WriteString(r.schulze.format(cands) + "\n")
+	if winner, ok := r.schulze.winner(); !ok {
+		buf.WriteString("No unique winner\n")
+	} else if condorcet, ok := condorcetWinner(r.p); ok && condorcet == winner {
+		fmt.Fprintln(&buf, cands[winner], "(condorcet winner)")
+	} else {
+		fmt.Fprintln(&buf, cands[winner], "wins")
+	}
+	counts, _ := preferenceGrids(r.p, cands, r.contest.description)
+	buf.WriteString("Preferences (row over column):\n")
+	buf.WriteString(formatCandidateGrid(counts))
+	buf.WriteString("Strongest paths (row over column):\n")
+	buf.WriteString(formatCandidateGrid(pathGrid(r.p, r.paths, cands, r.contest.description)))
+	buf.WriteString("\n")
+
+	buf.WriteString("Other Condorcet methods\n")
+	fmt.Fprintln(&buf, "Ranked pairs:", r.rankedPairs.format(cands))
+	fmt.Fprintln(&buf, "Minimax:", r.minimax.format(cands))
+	fmt.Fprintln(&buf, "Copeland:", r.copeland.format(cands))
+	if r.kemeny != nil {
+		fmt.Fprintf(&buf, "Kemeny-Young: %v%v\n", r.kemeny.format(cands),
+			ternary(r.kemenyN > 1, fmt.Sprintf(" (one of %v optimal orderings)", r.kemenyN), ""))
+	} else {
+		fmt.Fprintf(&buf, "Kemeny-Young: skipped, more than %v candidates\n", maxKemenyCandidates)
+	}
+	buf.WriteString("\n")
+	return buf.String()
+}
+
+// writeFiles writes the IRV transfers, Sankey diagram, and RCTab summary (if
+// there was an IRV tabulation), and the preference grids, to files starting
+// with prefix.
+func (r *RCVResult) writeFiles(prefix string) {
+	cands := r.contest.candidates
+	basename := prefix + "irv_" + r.contest.name
+	if len(r.irv) > 0 {
+		if wantFormat("csv") {
+			writeFile(basename+"_transfers.csv", formatGrid(transferGrid(r.irv, cands)))
+		}
+		if wantFormat("html") {
+			writeFile(basename+"_sankey.html", formatSankeyHTML(r.contest.description, r.irv, cands))
+		}
+		if wantFormat("json") {
+			rctab, err := rctabJSON(r.contest.description, r.ballots, r.irv, r.contest.fullNames)
 			if err != nil {
 				panic(err)
 			}
-			stringResults[voteStr]++
-			rankResults = append(rankResults, ranks)
+			writeFile(basename+"_rctab.json", string(rctab))
 		}
 	}
 
-	fmt.Printf("%v (RCV, rank up to %v)\n", contestInfo.Description, contestInfo.NumOfRanks)
-	fmt.Print(formatResults(stringResults))
-	fmt.Println()
-
-	fmt.Println("Ballot summary")
-	fmt.Print(rcvBallotSummary(rankResults, cands))
-	fmt.Println()
-
-	irvResults := runIRV(rankResults, cands)
-	for i, round := range irvResults {
-		fmt.Printf("IRV Round %v\n", i+1)
-		fmt.Print(formatResults(round.topChoices))
-		if i == len(irvResults)-1 {
-			fmt.Println(round.eliminated, "wins")
-		} else {
-			fmt.Println(round.eliminated, "is eliminated")
-		}
-		fmt.Println()
-	}
+	counts, shares := preferenceGrids(r.p, cands, r.contest.description)
+	writeGrid(prefix, "prefs_"+r.contest.name, counts)
+	writeGrid(prefix, "pref_shares_"+r.contest.name, shares)
+}
 
-	fmt.Println("Borda count")
-	fmt.Print(formatResults(runPositional(rankResults, cands, borda(contestInfo.NumOfRanks))))
-	fmt.Println()
+// CrosstabResult is how voters voted across several contests.
+type CrosstabResult struct {
+	resultHeader
+	Contests []ContestInfo `json:"contests"`
+	// whether ballots that abstain or vote invalidly in any of the contests
+	// are counted together as Incomplete
+	Coalesced bool `json:"coalesced"`
+	// ballots that vote in any of the contests, by their vote in each
+	Combinations []Combination `json:"combinations"`
+	Incomplete   int           `json:"incomplete"`
+
+	results map[string]int
+}
 
-	fmt.Println("Nauru/Dowdall method")
-	fmt.Print(formatResults(runPositional(rankResults, cands, dowdall)))
-	fmt.Println()
+// Combination is a number of ballots with the same vote in each contest.
+type Combination struct {
+	// for each contest, the candidate, or Abstain or Invalid (with ID 0)
+	Votes []CandidateInfo `json:"votes"`
+	Count int             `json:"count"`
+}
 
-	fmt.Println("Schulze method")
-	winner, prefs, paths := runSchulze(rankResults, cands)
-	fmt.Println(winner, ternary(paths == nil, "(condorcet winner)", ""))
-	fmt.Println("Preferences:")
-	fmt.Print(formatResults(prefs))
-	if paths != nil {
-		fmt.Println("Strongest paths:")
-		fmt.Print(formatResults(paths))
+// voteInfo returns the info for a vote code in a column: the candidate, or
+// Abstain or Invalid.
+func (c candidateNames) voteInfo(column *contestColumn, code uint16) CandidateInfo {
+	switch {
+	case code == 0:
+		return otherVote(abstain)
+	case column.ids[code] == 0:
+		return otherVote(column.labels[code])
+	default:
+		return c.info(column.ids[code])
 	}
-	fmt.Println()
 }
 
-func AnalyzeManyContests(b *BallotData, coalesceInvalid bool, contestIDs ...int) map[string]int {
-	var err error
-	candss := make([]map[int]string, len(contestIDs))
-	for i, contestID := range contestIDs {
-		candss[i], err = candidates(b, contestID)
-		if err != nil {
-			panic(err)
-		}
-	}
+func AnalyzeManyContests(b *BallotData, coalesceInvalid bool, contestIDs ...int) *CrosstabResult {
+	names := map1(func(id int) candidateNames { return contestCandidateNames(b, id) }, contestIDs)
+	cols := b.contestColumns(contestIDs...)
 
 	// Pad names consistently
-	ws := make([]int, len(candss))
-	for i, cands := range candss {
-		if !coalesceInvalid {
-			ws[i] = len(abstain)
-		}
-		for _, name := range cands {
-			if ws[i] < len(name) {
-				ws[i] = len(name)
-			}
-		}
-		for id, name := range cands {
-			cands[id] = fmt.Sprintf("%-"+strconv.Itoa(ws[i])+"v", name)
+	padded := make([][]string, len(cols))
+	for i, col := range cols {
+		w := ternary(coalesceInvalid, 0, len(abstain))
+		for _, name := range col.labels[1 : len(col.labels)-2] {
+			w = max(w, len(name))
 		}
+		padded[i] = map1(func(label string) string {
+			return fmt.Sprintf("%-"+strconv.Itoa(w)+"v", label)
+		}, col.labels)
 	}
 
 	contestToIndex := make(map[int]int, len(contestIDs))
@@ -504,99 +934,153 @@ func AnalyzeManyContests(b *BallotData, coalesceInvalid bool, contestIDs ...int)
 		contestToIndex[contestID] = i
 	}
 
-	results := map[string]int{}
+	// Count each combination of vote codes, then label them. Contests may be
+	// on different cards of the same ballot.
+	combinations := map[string]int{}
 	incomplete := 0
-
-	for _, card := range b.Cards {
-		votes := make([]string, len(contestIDs))
-		for i := range votes {
-			votes[i] = abstain
-		}
+	key := make([]byte, 2*len(cols))
+	for k := range cols[0].codes {
 		nVotes := 0
-
-		for _, contest := range card.Contests {
-			i, ok := contestToIndex[contest.ID]
-			if !ok {
-				continue
-			}
-
-			vote, err := scoreContest(contest, candss[i])
-			if err != nil {
-				panic(err)
+		complete := true
+		for i, col := range cols {
+			code := col.codes[k]
+			if contestToIndex[contestIDs[i]] != i {
+				code = 0 // a repeated contest only counts once
 			}
-
-			if vote == abstain || vote == invalid {
-				if coalesceInvalid {
-					incomplete++
-					nVotes = 0
-					break
-				} else {
-					vote = fmt.Sprintf("%-"+strconv.Itoa(ws[i])+"v", vote)
+			if code != 0 {
+				nVotes++
+				if coalesceInvalid && int(code) >= len(col.labels)-2 {
+					complete = false // abstain or invalid
 				}
 			}
-
-			votes[i] = vote
-			nVotes++
+			binary.LittleEndian.PutUint16(key[2*i:], code)
 		}
-		if nVotes == 0 {
-			continue
+		switch {
+		case !complete:
+			incomplete++
+		case nVotes > 0:
+			combinations[string(key)]++
 		}
+	}
 
-		voteString := strings.Join(votes, "|")
-		results[voteString]++
+	ret := &CrosstabResult{
+		resultHeader: resultHeader{Type: "crosstab"},
+		Contests:     map1(func(id int) ContestInfo { return contestInfo(b, id) }, contestIDs),
+		Coalesced:    coalesceInvalid,
+		Combinations: []Combination{},
+		Incomplete:   incomplete,
+		results:      map[string]int{},
+	}
+	// The text results go by name; the combinations go by candidate, sorted
+	// by name and then by code.
+	keys := maps.Keys(combinations)
+	slices.Sort(keys)
+	labels := make(map[string]string, len(keys))
+	votes := make([]string, len(cols))
+	for _, key := range keys {
+		for i := range cols {
+			code := binary.LittleEndian.Uint16([]byte(key[2*i:]))
+			votes[i] = ternary(code == 0, abstain, padded[i][code])
+		}
+		labels[key] = strings.Join(votes, "|")
+		ret.results[labels[key]] += combinations[key]
+	}
+	slices.SortStableFunc(keys, func(x, y string) bool { return less(labels[x], labels[y]) })
+	for _, key := range keys {
+		c := Combination{Count: combinations[key]}
+		for i, col := range cols {
+			c.Votes = append(c.Votes, names[i].voteInfo(col, binary.LittleEndian.Uint16([]byte(key[2*i:]))))
+		}
+		ret.Combinations = append(ret.Combinations, c)
 	}
 	if coalesceInvalid {
-		results["Incomplete"] = incomplete
+		ret.results["Incomplete"] = incomplete
 	}
+	return ret
+}
 
-	return results
+func (r *CrosstabResult) Text() string {
+	return formatResults(r.results) + "\n"
 }
 
-func GridChart(b *BallotData, coalesceInvalid bool, contestIDs ...int) [][]any {
-	ns := make([]int, len(contestIDs))
-	candss := make([][]string, len(contestIDs))
-	for i, contestID := range contestIDs {
-		cands, err := candidates(b, contestID)
-		if err != nil {
-			panic(err)
-		}
-		candss[i] = maps.Values(cands)
-		if !coalesceInvalid {
-			candss[i] = append(candss[i], abstain, invalid)
-		}
-		slices.SortFunc(candss[i], less)
-		ns[i] = len(candss[i])
-	}
+// GridResult is, for each pair of contests, the share of ballots that vote
+// for each pair of candidates.
+type GridResult struct {
+	resultHeader
+	Contests []ContestInfo `json:"contests"`
+	// whether ballots that abstain or vote invalidly are left out
+	Coalesced bool       `json:"coalesced"`
+	Cells     []GridCell `json:"cells"`
 
-	// hack hack hack pad names to match AnalyzeManyContests
-	for _, cands := range candss {
-		w := 0
-		for _, name := range cands {
-			if w < len(name) {
-				w = len(name)
+	grid [][]any
+}
+
+// GridCell is the share of ballots voting in a pair of contests that vote
+// for a pair of candidates.
+type GridCell struct {
+	RowContestID int `json:"rowContestId"`
+	// the candidate, or Abstain or Invalid (with ID 0)
+	Row             CandidateInfo `json:"row"`
+	ColumnContestID int           `json:"columnContestId"`
+	Column          CandidateInfo `json:"column"`
+	Share           float64       `json:"share"`
+}
+
+// gridEntry is a row or column of a grid: a candidate, or Abstain or Invalid,
+// and the vote codes that count for it.
+type gridEntry struct {
+	info  CandidateInfo
+	codes []uint16
+}
+
+func GridChart(b *BallotData, coalesceInvalid bool, contestIDs ...int) *GridResult {
+	// score every contest in one pass, rather than one per contest as each
+	// pair needs it
+	cols := b.contestColumns(contestIDs...)
+
+	entries := make([][]gridEntry, len(contestIDs))
+	for i, contestID := range contestIDs {
+		names := contestCandidateNames(b, contestID)
+		col := cols[i]
+		for code, id := range col.ids {
+			if id != 0 {
+				entries[i] = append(entries[i], gridEntry{names.info(id), []uint16{uint16(code)}})
 			}
 		}
-		for i, name := range cands {
-			cands[i] = fmt.Sprintf("%-"+strconv.Itoa(w)+"v", name)
+		if !coalesceInvalid {
+			// a ballot without the contest abstains, as in AnalyzeManyContests
+			n := uint16(len(col.labels))
+			entries[i] = append(entries[i],
+				gridEntry{otherVote(abstain), []uint16{0, n - 2}},
+				gridEntry{otherVote(invalid), []uint16{n - 1}})
 		}
+		slices.SortStableFunc(entries[i], func(x, y gridEntry) bool { return less(x.info.Name, y.info.Name) })
 	}
+	ns := map1(func(e []gridEntry) int { return len(e) }, entries)
 
 	h, w := sum(ns[1:]), sum(ns[:len(ns)-1])
 
-	ret := make([][]any, h+2)
+	ret := &GridResult{
+		resultHeader: resultHeader{Type: "grid"},
+		Contests:     map1(func(id int) ContestInfo { return contestInfo(b, id) }, contestIDs),
+		Coalesced:    coalesceInvalid,
+		Cells:        []GridCell{},
+		grid:         make([][]any, h+2),
+	}
+	grid := ret.grid
 	c := 2
-	ret[0] = make([]any, w+2)
+	grid[0] = make([]any, w+2)
 	for j := 0; j < len(ns)-1; j++ {
 		for m := 0; m < ns[j]; m++ {
-			ret[0][c+m] = b.Contests[contestIDs[j]].Description
+			grid[0][c+m] = b.Contests[contestIDs[j]].Description
 		}
 		c += ns[j]
 	}
-	ret[1] = make([]any, w+2)
+	grid[1] = make([]any, w+2)
 	c = 2
 	for j := 0; j < len(ns)-1; j++ {
 		for m := 0; m < ns[j]; m++ {
-			ret[1][c+m] = strings.TrimSpace(candss[j][m])
+			grid[1][c+m] = entries[j][m].info.Name
 		}
 		c += ns[j]
 	}
@@ -604,21 +1088,44 @@ func GridChart(b *BallotData, coalesceInvalid bool, contestIDs ...int) [][]any {
 	r := 2
 	for i := 1; i < len(contestIDs); i++ {
 		for k := 0; k < ns[i]; k++ {
-			ret[r+k] = make([]any, w+2)
-			ret[r+k][0] = b.Contests[contestIDs[i]].Description
-			ret[r+k][1] = strings.TrimSpace(candss[i][k])
+			grid[r+k] = make([]any, w+2)
+			grid[r+k][0] = b.Contests[contestIDs[i]].Description
+			grid[r+k][1] = entries[i][k].info.Name
 		}
 		c := 2
 		for j := 0; j < i; j++ {
-			results := AnalyzeManyContests(b, coalesceInvalid, contestIDs[i], contestIDs[j])
-			total := sum(maps.Values(results))
-
-			for k := 0; k < ns[i]; k++ {
-				cand1 := candss[i][k]
-				for m := 0; m < ns[j]; m++ {
-					cand2 := candss[j][m]
-					votes := results[cand1+"|"+cand2]
-					ret[r+k][c+m] = float64(votes) / float64(total)
+			// Count ballots by their vote in each contest; the total, as in
+			// AnalyzeManyContests, is of ballots with either.
+			counts := map[[2]uint16]int{}
+			total := 0
+			for n, code1 := range cols[i].codes {
+				code2 := cols[j].codes[n]
+				if contestIDs[i] == contestIDs[j] {
+					code2 = 0 // a repeated contest only counts once
+				}
+				if code1 != 0 || code2 != 0 {
+					counts[[2]uint16{code1, code2}]++
+					total++
+				}
+			}
+
+			for k, row := range entries[i] {
+				for m, col := range entries[j] {
+					votes := 0
+					for _, code1 := range row.codes {
+						for _, code2 := range col.codes {
+							votes += counts[[2]uint16{code1, code2}]
+						}
+					}
+					share := float64(votes) / float64(total)
+					grid[r+k][c+m] = share
+					ret.Cells = append(ret.Cells, GridCell{
+						RowContestID:    contestIDs[i],
+						Row:             row.info,
+						ColumnContestID: contestIDs[j],
+						Column:          col.info,
+						Share:           share,
+					})
 				}
 			}
 
@@ -629,6 +1136,22 @@ func GridChart(b *BallotData, coalesceInvalid bool, contestIDs ...int) [][]any {
 	return ret
 }
 
+// Text lays out the grid as a table of percentages.
+func (r *GridResult) Text() string {
+	return formatTable(map1(func(row []any) []string {
+		return map1(func(cell any) string {
+			switch cell := cell.(type) {
+			case nil:
+				return ""
+			case float64:
+				return fmt.Sprintf("%.1f%%", 100*cell)
+			default:
+				return fmt.Sprint(cell)
+			}
+		}, row)
+	}, r.grid)) + "\n"
+}
+
 func ShowPrecinctPortions(b *BallotData) {
 	counts := make(map[int]int)
 	for _, cvr := range b.Raw.CVRs {
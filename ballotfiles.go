@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Ranked ballots in the BLT format used by OpenSTV, pyrankvote, and others,
+// and in PrefLib's SOI (strict orders, incomplete) and TOI (orders with ties,
+// incomplete) formats. Both number candidates from 1; we number them in order
+// of ID.
+
+// candidateNumbers returns the candidate IDs in order, and a map from ID to
+// its number in the file.
+func candidateNumbers(candidates map[int]string) ([]int, map[int]int) {
+	ids := maps.Keys(candidates)
+	slices.Sort(ids)
+	numbers := make(map[int]int, len(ids))
+	for i, id := range ids {
+		numbers[id] = i + 1
+	}
+	return ids, numbers
+}
+
+// countedRankings groups identical, non-empty rankings, most common first.
+func countedRankings(ranks [][]int) []*stvBallot {
+	groups := groupRankings(ranks)
+	slices.SortStableFunc(groups, func(g1, g2 *stvBallot) bool { return g1.weight > g2.weight })
+	return groups
+}
+
+func formatBLT(title string, ranks [][]int, candidates map[int]string, seats int) string {
+	ids, numbers := candidateNumbers(candidates)
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%d %d\n", len(ids), seats)
+	for _, group := range countedRankings(ranks) {
+		fmt.Fprintf(&buf, "%d", int(group.weight))
+		for _, id := range group.ranks {
+			fmt.Fprintf(&buf, " %d", numbers[id])
+		}
+		buf.WriteString(" 0\n")
+	}
+	buf.WriteString("0\n")
+	for _, id := range ids {
+		fmt.Fprintf(&buf, "%s\n", bltString(candidates[id]))
+	}
+	fmt.Fprintf(&buf, "%s\n", bltString(title))
+	return buf.String()
+}
+
+// bltString quotes a name or title for a BLT file. BLT has no escapes: a
+// string runs from one double quote to the next. So we write double quotes
+// within it as single quotes, as in "JOHN 'JACK' SMITH".
+func bltString(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, "'") + `"`
+}
+
+func formatPrefLib(filename, title string, ranks [][]int, candidates map[int]string, dataType string) string {
+	ids, numbers := candidateNumbers(candidates)
+	groups := countedRankings(ranks)
+	voters := 0
+	for _, group := range groups {
+		voters += int(group.weight)
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "# FILE NAME: %s\n", filepath.Base(filename))
+	fmt.Fprintf(&buf, "# TITLE: %s\n", title)
+	fmt.Fprintf(&buf, "# DATA TYPE: %s\n", dataType)
+	fmt.Fprintf(&buf, "# MODIFICATION TYPE: original\n")
+	fmt.Fprintf(&buf, "# NUMBER ALTERNATIVES: %d\n", len(ids))
+	fmt.Fprintf(&buf, "# NUMBER VOTERS: %d\n", voters)
+	fmt.Fprintf(&buf, "# NUMBER UNIQUE ORDERS: %d\n", len(groups))
+	for _, id := range ids {
+		fmt.Fprintf(&buf, "# ALTERNATIVE NAME %d: %s\n", numbers[id], candidates[id])
+	}
+	for _, group := range groups {
+		fmt.Fprintf(&buf, "%d: %s\n", int(group.weight),
+			strings.Join(map1(func(id int) string { return strconv.Itoa(numbers[id]) }, group.ranks), ","))
+	}
+	return buf.String()
+}
+
+// bltTokens splits BLT input into whitespace-separated tokens, keeping quoted
+// strings (which may contain spaces, but not double quotes) together, and
+// dropping comments.
+func bltTokens(r io.Reader) ([]string, error) {
+	var tokens []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		for {
+			line = strings.TrimLeft(line, " \t\r")
+			if line == "" || line[0] == '#' {
+				break
+			}
+			if line[0] == '"' {
+				end := strings.IndexByte(line[1:], '"')
+				if end == -1 {
+					return nil, fmt.Errorf("unterminated string: %v", line)
+				}
+				tokens = append(tokens, line[:end+2])
+				line = line[end+2:]
+				continue
+			}
+			end := strings.IndexAny(line, " \t\r")
+			if end == -1 {
+				end = len(line)
+			}
+			tokens = append(tokens, line[:end])
+			line = line[end:]
+		}
+	}
+	return tokens, scanner.Err()
+}
+
+// parseBLT reads a BLT file, returning its rankings with their weights, which
+// may be fractional. Candidates are numbered as in the file; withdrawn
+// candidates are dropped from every ranking. Tied rankings (written "1=2")
+// end the ranking there, like an overvote.
+func parseBLT(r io.Reader) (ranks []*stvBallot, candidates map[int]string, seats int, title string, err error) {
+	tokens, err := bltTokens(r)
+	if err != nil {
+		return nil, nil, 0, "", err
+	}
+	next := func() (string, error) {
+		if len(tokens) == 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		tok := tokens[0]
+		tokens = tokens[1:]
+		return tok, nil
+	}
+	nextInt := func() (int, error) {
+		tok, err := next()
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(tok)
+	}
+
+	n, err := nextInt()
+	if err != nil {
+		return nil, nil, 0, "", fmt.Errorf("reading candidate count: %w", err)
+	}
+	seats, err = nextInt()
+	if err != nil {
+		return nil, nil, 0, "", fmt.Errorf("reading seat count: %w", err)
+	}
+
+	withdrawn := map[int]bool{}
+	for len(tokens) > 0 && strings.HasPrefix(tokens[0], "-") {
+		id, err := nextInt()
+		if err != nil {
+			return nil, nil, 0, "", err
+		}
+		withdrawn[-id] = true
+	}
+
+	for {
+		tok, err := next()
+		if err != nil {
+			return nil, nil, 0, "", err
+		}
+		if strings.HasPrefix(tok, "(") { // optional ballot ID
+			tok, err = next()
+			if err != nil {
+				return nil, nil, 0, "", err
+			}
+		}
+		weight, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, nil, 0, "", fmt.Errorf("reading ballot weight: %w", err)
+		}
+		if weight == 0 {
+			break
+		}
+
+		var ranking []int
+		tied := false
+		for {
+			tok, err := next()
+			if err != nil {
+				return nil, nil, 0, "", err
+			}
+			if tok == "0" {
+				break
+			}
+			if tied {
+				continue
+			}
+			if strings.Contains(tok, "=") {
+				tied = true
+				continue
+			}
+			if tok == "-" { // skipped rank
+				continue
+			}
+			id, err := strconv.Atoi(tok)
+			if err != nil {
+				return nil, nil, 0, "", fmt.Errorf("reading ranking: %w", err)
+			}
+			if id < 1 || id > n {
+				return nil, nil, 0, "", fmt.Errorf("unexpected candidate: %v", id)
+			}
+			if !withdrawn[id] && !slices.Contains(ranking, id) {
+				ranking = append(ranking, id)
+			}
+		}
+		ranks = append(ranks, &stvBallot{ranks: ranking, weight: weight})
+	}
+
+	candidates = make(map[int]string, n)
+	for i := 1; i <= n; i++ {
+		tok, err := next()
+		if err != nil {
+			return nil, nil, 0, "", fmt.Errorf("reading candidate names: %w", err)
+		}
+		if !withdrawn[i] {
+			candidates[i] = unquoteBLT(tok)
+		}
+	}
+	if tok, err := next(); err == nil {
+		title = unquoteBLT(tok)
+	}
+	return ranks, candidates, seats, title, nil
+}
+
+func unquoteBLT(tok string) string {
+	if len(tok) >= 2 && tok[0] == '"' {
+		return tok[1 : len(tok)-1]
+	}
+	return tok
+}
+
+// parsePrefLib reads a PrefLib SOI or TOI file. A tie ("{1,2}") ends the
+// ranking there, like an overvote.
+func parsePrefLib(r io.Reader) (ranks [][]int, candidates map[int]string, title string, err error) {
+	candidates = map[int]string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			key, value, _ := strings.Cut(strings.TrimSpace(line[1:]), ":")
+			value = strings.TrimSpace(value)
+			if key == "TITLE" {
+				title = value
+			} else if strings.HasPrefix(key, "ALTERNATIVE NAME ") {
+				id, err := strconv.Atoi(strings.TrimPrefix(key, "ALTERNATIVE NAME "))
+				if err != nil {
+					return nil, nil, "", fmt.Errorf("bad alternative: %v", line)
+				}
+				candidates[id] = value
+			}
+			continue
+		}
+
+		countStr, order, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, nil, "", fmt.Errorf("bad order: %v", line)
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(countStr))
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("bad count: %v", line)
+		}
+		var ranking []int
+		for _, tok := range strings.Split(order, ",") {
+			tok = strings.TrimSpace(tok)
+			if tok == "" {
+				continue
+			}
+			if strings.HasPrefix(tok, "{") {
+				break
+			}
+			id, err := strconv.Atoi(tok)
+			if err != nil {
+				return nil, nil, "", fmt.Errorf("bad order: %v", line)
+			}
+			if _, ok := candidates[id]; !ok {
+				return nil, nil, "", fmt.Errorf("unexpected candidate: %v", id)
+			}
+			ranking = append(ranking, id)
+		}
+		for i := 0; i < count; i++ {
+			ranks = append(ranks, ranking)
+		}
+	}
+	return ranks, candidates, title, scanner.Err()
+}
+
+// isRankedBallotFile reports whether the path is a BLT or PrefLib file, rather
+// than a CVR export.
+func isRankedBallotFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".blt", ".soi", ".toi":
+		return true
+	default:
+		return false
+	}
+}
+
+// RankedBallotFile is the ballots in a BLT or PrefLib file, as a ranked
+// contest.
+type RankedBallotFile struct {
+	path    string
+	contest rankedContest
+	ballots []rcvBallot
+	// from a BLT file: the exact weights, if the ballots were rounded from them
+	weighted []*stvBallot
+	seats    int // from a BLT file, or 0
+}
+
+// ReadRankedBallotFile reads a BLT or PrefLib file.
+func ReadRankedBallotFile(path string) *RankedBallotFile {
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	var ranks [][]int
+	var fullNames map[int]string
+	var title string
+	var seats int
+	var weighted []*stvBallot
+	if strings.ToLower(filepath.Ext(path)) == ".blt" {
+		weighted, fullNames, seats, title, err = parseBLT(f)
+		var rounded bool
+		ranks, rounded = wholeBallots(weighted)
+		if rounded {
+			fmt.Fprintf(os.Stderr, "%v: rounded fractional ballot weights to whole ballots, except for STV\n", path)
+		} else {
+			weighted = nil
+		}
+	} else {
+		ranks, fullNames, title, err = parsePrefLib(f)
+	}
+	if err != nil {
+		panic(fmt.Errorf("%v: %w", path, err))
+	}
+
+	cands := make(map[int]string, len(fullNames))
+	for id, name := range fullNames {
+		cands[id] = shortName(name)
+	}
+	ballots := make([]rcvBallot, len(ranks))
+	numRanks := 0
+	for i, ranking := range ranks {
+		ballots[i].ranks = ranking
+		numRanks = max(numRanks, len(ranking))
+	}
+	return &RankedBallotFile{
+		path: path,
+		contest: rankedContest{
+			name:        "file",
+			description: title,
+			numRanks:    numRanks,
+			candidates:  cands,
+			fullNames:   fullNames,
+		},
+		ballots:  ballots,
+		weighted: weighted,
+		seats:    seats,
+	}
+}
+
+// AnalyzeRankedBallotFile analyzes the ballots in a BLT or PrefLib file as we
+// would a ranked contest.
+func AnalyzeRankedBallotFile(f *RankedBallotFile, opts rcvOptions) *RCVResult {
+	if opts.stv.seats == 0 && f.seats > 1 {
+		opts.stv.seats = f.seats
+	}
+	ret := analyzeRankedBallots(f.contest, f.ballots, f.weighted, opts)
+	ret.heading = fmt.Sprintf("%v (%v ballots from %v)\n\n",
+		f.contest.description, len(f.ballots), filepath.Base(f.path))
+	return ret
+}
+
+// wholeBallots expands weighted rankings into ballots, and reports whether
+// any weights were rounded. Every method but STV counts whole ballots, so
+// fractional weights (as some STV programs write for transferred ballots) are
+// rounded for them.
+func wholeBallots(weighted []*stvBallot) ([][]int, bool) {
+	var ranks [][]int
+	rounded := false
+	for _, group := range weighted {
+		n := math.Round(group.weight)
+		rounded = rounded || n != group.weight
+		for i := 0; i < int(n); i++ {
+			ranks = append(ranks, group.ranks)
+		}
+	}
+	return ranks, rounded
+}
+
+// writeRankedBallotFiles writes the ballots for a ranked contest in each of
+// the given formats: blt, soi, or toi.
+func writeRankedBallotFiles(prefix string, contest rankedContest, ballots []rcvBallot, seats int, formats []string) {
+	ranks := rankings(ballots)
+	basename := prefix + "ballots_" + contest.name
+	for _, format := range formats {
+		filename := basename + "." + format
+		switch format {
+		case "blt":
+			writeFile(filename, formatBLT(contest.description, ranks, contest.fullNames, max(seats, 1)))
+		case "soi", "toi":
+			writeFile(filename, formatPrefLib(filename, contest.description, ranks, contest.fullNames, format))
+		default:
+			panic(fmt.Sprintf("unknown ranked ballot format %q", format))
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// cacheVersion changes whenever RawBallotData does, to invalidate old caches.
+const cacheVersion = 2
+
+// cacheDir is where LoadAll caches exports, or empty to not cache them.
+var cacheDir = defaultCacheDir()
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sfballots")
+}
+
+// sourceHash hashes a CVR export: the size and modification time of a ZIP
+// file, and its central directory, which has each file's name, size, and
+// CRC; or the names, sizes, and modification times of the files in a
+// directory. (Reading every file would take nearly as long as parsing them.)
+func sourceHash(dirOrZip string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "sfballots cache v%d\n", cacheVersion)
+
+	stat, err := os.Stat(dirOrZip)
+	if err != nil {
+		return "", err
+	}
+	if stat.IsDir() {
+		entries, err := os.ReadDir(dirOrZip)
+		if err != nil {
+			return "", err
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "%s %d %d\n", entry.Name(), info.Size(), info.ModTime().UnixNano())
+		}
+	} else {
+		fmt.Fprintf(h, "%d %d\n", stat.Size(), stat.ModTime().UnixNano())
+		r, err := zip.OpenReader(dirOrZip)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			fmt.Fprintf(h, "%s %d %d %08x\n", f.Name, f.CompressedSize64, f.UncompressedSize64, f.CRC32)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cachePrefix returns the start of the names of cache files for an export.
+func cachePrefix(dirOrZip string) (string, error) {
+	abs, err := filepath.Abs(dirOrZip)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(abs))
+	return hex.EncodeToString(h[:8]) + "-", nil
+}
+
+func readCache(filename string) (*RawBallotData, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	var out RawBallotData
+	err = dec.Decode(&out)
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	err = dec.Decode(&n)
+	if err != nil {
+		return nil, err
+	}
+	out.CVRs = make([]*RawCVR, n)
+	for i := range out.CVRs {
+		err = dec.Decode(&out.CVRs[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &out, nil
+}
+
+// writeCache writes the cache file, replacing any others with the same
+// prefix.
+func writeCache(filename, prefix string, d *RawBallotData) error {
+	dir := filepath.Dir(filename)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file, so a concurrent run never reads half of it
+	tmp, err := os.CreateTemp(dir, prefix+"*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	err = encodeCache(gob.NewEncoder(w), d)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		return err
+	}
+
+	stale, err := filepath.Glob(filepath.Join(dir, prefix+"*.gob"))
+	if err != nil {
+		return err
+	}
+	for _, name := range stale {
+		if name != filename {
+			err = os.Remove(name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encodeCache encodes the manifests, the number of CVRs, and then each CVR.
+func encodeCache(enc *gob.Encoder, d *RawBallotData) error {
+	manifests := *d
+	manifests.CVRs = nil
+	err := enc.Encode(&manifests)
+	if err == nil {
+		err = enc.Encode(len(d.CVRs))
+	}
+	for _, cvr := range d.CVRs {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(cvr)
+	}
+	return err
+}
+
+// LoadAll loads a CVR export, from the cache if it's there. It caches each
+// export it parses, as gobs of the manifests and then of each RawCVR in turn,
+// so later runs needn't parse all the JSON again. (A single gob of the whole
+// RawBallotData would be built in memory first, and can't be over 8 GB.)
+// Cache files are named for a hash of the export's path and a hash of its
+// contents; when the export changes, we replace its old cache file.
+func LoadAll(dirOrZip string) (*RawBallotData, error) {
+	if cacheDir == "" {
+		return loadAll(dirOrZip)
+	}
+	hash, err := sourceHash(dirOrZip)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := cachePrefix(dirOrZip)
+	if err != nil {
+		return nil, err
+	}
+	filename := filepath.Join(cacheDir, prefix+hash+".gob")
+
+	out, err := readCache(filename)
+	switch {
+	case err == nil:
+		logf("using cache %v", filename)
+		return out, nil
+	case !errors.Is(err, fs.ErrNotExist):
+		logf("ignoring cache %v: %v", filename, err)
+	}
+
+	out, err = loadAll(dirOrZip)
+	if err != nil {
+		return nil, err
+	}
+	err = writeCache(filename, prefix, out)
+	if err != nil {
+		logf("not caching %v: %v", dirOrZip, err)
+	} else {
+		logf("cached %v in %v", dirOrZip, filename)
+	}
+	return out, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Rather than rescan every ballot for each analysis, we score each contest
+// once, into a column with an entry per ballot, in the order of EachBallot.
+// Tallies and crosstabs are then scans of one or a few columns.
+
+// A contestColumn is how each ballot voted in a contest, as scored by
+// scoreContest.
+type contestColumn struct {
+	// per ballot, 0 if the contest isn't on it, or an index into labels
+	codes []uint16
+	// "", each candidate's short name (by candidate ID), Abstain, Invalid
+	labels []string
+	// the candidate ID for each label, or 0
+	ids []int
+}
+
+// counts returns the number of ballots with each vote.
+func (c *contestColumn) counts() map[string]int {
+	counts := make([]int, len(c.labels))
+	for _, code := range c.codes {
+		counts[code]++
+	}
+	ret := map[string]int{}
+	for code, n := range counts {
+		if code != 0 && n > 0 {
+			ret[c.labels[code]] += n
+		}
+	}
+	return ret
+}
+
+// votes returns the number of ballots with each vote, by candidate ID.
+func (c *contestColumn) votes() []voteCount {
+	counts := make([]int, len(c.labels))
+	for _, code := range c.codes {
+		counts[code]++
+	}
+	var ret []voteCount
+	for code, n := range counts {
+		if code != 0 && n > 0 {
+			ret = append(ret, voteCount{c.candidateIDs(uint16(code)), c.labels[code], n})
+		}
+	}
+	return ret
+}
+
+// candidateIDs returns the candidate a code is a vote for, if it's one.
+func (c *contestColumn) candidateIDs(code uint16) []int {
+	if c.ids[code] == 0 {
+		return nil
+	}
+	return []int{c.ids[code]}
+}
+
+// An rcvColumn is how each ballot ranked a contest, as scored by
+// scoreRCVContest under some rules. Only ballots with the contest are
+// included.
+type rcvColumn struct {
+	// every ballot's ranks, end to end: ballot i's end at ends[i]
+	ranks     []int
+	ends      []int
+	overvoted []bool
+	// ballots by how they're marked, as from scoreRCVContest
+	results map[string]int
+}
+
+type rcvColumnKey struct {
+	contestID int
+	rules     rcvBallotRules
+}
+
+// ballots returns the ballots, as rcvContestBallots does; their ranks share
+// the column's storage.
+func (c *rcvColumn) ballots() []rcvBallot {
+	ret := make([]rcvBallot, len(c.ends))
+	start := 0
+	for i, end := range c.ends {
+		ret[i] = rcvBallot{ranks: c.ranks[start:end:end], overvoted: c.overvoted[i]}
+		start = end
+	}
+	return ret
+}
+
+// contestColumns returns the columns for the given contests, scoring any we
+// haven't yet in one pass over the ballots.
+func (b *BallotData) contestColumns(contestIDs ...int) []*contestColumn {
+	if b.columns == nil {
+		b.columns = map[int]*contestColumn{}
+	}
+	var missing []int
+	lookups := map[int]map[int]uint16{} // contest ID -> candidate ID -> code
+	candss := map[int]map[int]string{}
+	for _, id := range contestIDs {
+		if _, ok := b.columns[id]; ok || slices.Contains(missing, id) {
+			continue
+		}
+		missing = append(missing, id)
+
+		cands, err := candidates(b, id)
+		if err != nil {
+			panic(err)
+		}
+		ids := maps.Keys(cands)
+		slices.Sort(ids)
+		column := &contestColumn{labels: []string{""}, ids: []int{0}}
+		for _, cand := range ids {
+			column.labels = append(column.labels, cands[cand])
+			column.ids = append(column.ids, cand)
+		}
+		column.labels = append(column.labels, abstain, invalid)
+		column.ids = append(column.ids, 0, 0)
+		lookups[id] = make(map[int]uint16, len(ids))
+		for code, cand := range column.ids {
+			if cand != 0 {
+				lookups[id][cand] = uint16(code)
+			}
+		}
+		candss[id] = cands
+		b.columns[id] = column
+	}
+	if len(missing) > 0 {
+		b.forEachBallot(func(ballot *Ballot) {
+			for _, id := range missing {
+				column := b.columns[id]
+				column.codes = append(column.codes, 0)
+			}
+			n := len(b.columns[missing[0]].codes)
+			for _, card := range ballot.Cards {
+				for _, contest := range card.Contests {
+					lookup, ok := lookups[contest.ID]
+					if !ok {
+						continue
+					}
+					cand, vote, err := scoreContest(contest, candss[contest.ID])
+					if err != nil {
+						panic(err)
+					}
+					column := b.columns[contest.ID]
+					switch vote {
+					case abstain:
+						column.codes[n-1] = uint16(len(column.labels) - 2)
+					case invalid:
+						column.codes[n-1] = uint16(len(column.labels) - 1)
+					default:
+						column.codes[n-1] = lookup[cand]
+					}
+				}
+			}
+		})
+	}
+	return map1(func(id int) *contestColumn { return b.columns[id] }, contestIDs)
+}
+
+// rankedColumn returns the column for a ranked contest under the given
+// rules, scoring it if we haven't yet.
+func (b *BallotData) rankedColumn(contestID int, rules rcvBallotRules) *rcvColumn {
+	key := rcvColumnKey{contestID, rules}
+	if column, ok := b.rcvColumns[key]; ok {
+		return column
+	}
+	if b.rcvColumns == nil {
+		b.rcvColumns = map[rcvColumnKey]*rcvColumn{}
+	}
+
+	cands, err := candidates(b, contestID)
+	if err != nil {
+		panic(err)
+	}
+	numRanks := b.Contests[contestID].NumOfRanks
+	column := &rcvColumn{results: map[string]int{}}
+	b.forEachBallot(func(ballot *Ballot) {
+		for _, card := range ballot.Cards {
+			for _, contest := range card.Contests {
+				if contest.ID != contestID {
+					continue
+				}
+
+				scored, voteStr, err := scoreRCVContest(contest, cands, numRanks, rules)
+				if err != nil {
+					panic(err)
+				}
+				column.results[voteStr]++
+				column.ranks = append(column.ranks, scored.ranks...)
+				column.ends = append(column.ends, len(column.ranks))
+				column.overvoted = append(column.overvoted, scored.overvoted)
+			}
+		}
+	})
+	b.rcvColumns[key] = column
+	return column
+}
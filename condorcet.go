@@ -0,0 +1,520 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// pairwise holds the pairwise preferences of a set of ranked ballots.
+type pairwise struct {
+	cands []int          // candidate IDs, sorted
+	prefs map[[2]int]int // number of voters who prefer [0] to [1]
+}
+
+// pairwisePreferences counts the pairwise preferences of the rankings, over
+// all the candidates, so those nobody ranked come last.
+func pairwisePreferences(ranks [][]int, candidates map[int]string) pairwise {
+	candsMap := make(map[int]bool, len(candidates))
+	for id := range candidates {
+		candsMap[id] = true
+	}
+	for _, ranking := range ranks {
+		for _, rank := range ranking {
+			candsMap[rank] = true
+		}
+	}
+	prefsMap := map[[2]int]int{}
+	for _, ranking := range ranks {
+		seen := map[int]bool{}
+		for i, rank := range ranking {
+			seen[rank] = true
+			for _, otherRank := range ranking[i+1:] {
+				prefsMap[[2]int{rank, otherRank}] += 1
+			}
+		}
+		for cand := range candsMap {
+			if !seen[cand] {
+				// unranked candidates go after all ranked candidates
+				for _, rank := range ranking {
+					prefsMap[[2]int{rank, cand}] += 1
+				}
+			}
+		}
+	}
+	cands := maps.Keys(candsMap)
+	sort.Ints(cands)
+	return pairwise{cands, prefsMap}
+}
+
+func (p pairwise) margin(c1, c2 int) int {
+	return p.prefs[[2]int{c1, c2}] - p.prefs[[2]int{c2, c1}]
+}
+
+// ranking is a full ordering of candidates, best first, where each element is
+// a set of tied candidates.
+type ranking [][]int
+
+func (r ranking) format(candidates map[int]string) string {
+	tiers := make([]string, len(r))
+	for i, tier := range r {
+		names := map1(func(id int) string { return candidates[id] }, tier)
+		slices.Sort(names)
+		tiers[i] = strings.Join(names, " = ")
+	}
+	return strings.Join(tiers, " > ")
+}
+
+// winner returns the sole winner, or false if there's a tie for first.
+func (r ranking) winner() (int, bool) {
+	if len(r) == 0 || len(r[0]) != 1 {
+		return 0, false
+	}
+	return r[0][0], true
+}
+
+// rankByScore ranks candidates in decreasing order of score, with equal scores
+// tied.
+func rankByScore[T numeric](cands []int, score map[int]T) ranking {
+	sorted := slices.Clone(cands)
+	slices.SortStableFunc(sorted, func(c1, c2 int) bool { return score[c1] > score[c2] })
+	var ret ranking
+	for i, cand := range sorted {
+		if i > 0 && score[cand] == score[sorted[i-1]] {
+			ret[len(ret)-1] = append(ret[len(ret)-1], cand)
+		} else {
+			ret = append(ret, []int{cand})
+		}
+	}
+	return ret
+}
+
+// rankDAG ranks candidates according to a directed acyclic graph of victories:
+// the first tier is every candidate no one beats, the second every candidate
+// beaten only by the first tier, and so on.
+func rankDAG(cands []int, beats func(c1, c2 int) bool) ranking {
+	var ret ranking
+	remaining := slices.Clone(cands)
+	for len(remaining) > 0 {
+		var tier, rest []int
+		for _, c1 := range remaining {
+			beaten := false
+			for _, c2 := range remaining {
+				if c1 != c2 && beats(c2, c1) {
+					beaten = true
+				}
+			}
+			if beaten {
+				rest = append(rest, c1)
+			} else {
+				tier = append(tier, c1)
+			}
+		}
+		if len(tier) == 0 {
+			panic(fmt.Sprintf("cycle in %v", remaining))
+		}
+		ret = append(ret, tier)
+		remaining = rest
+	}
+	return ret
+}
+
+func condorcetWinner(p pairwise) (int, bool) {
+	for _, c1 := range p.cands {
+		winner := true
+		for _, c2 := range p.cands {
+			if c1 != c2 && p.margin(c1, c2) <= 0 {
+				winner = false
+			}
+		}
+		if winner {
+			return c1, true
+		}
+	}
+	return 0, false
+}
+
+func condorcetLoser(p pairwise) (int, bool) {
+	for _, c1 := range p.cands {
+		loser := true
+		for _, c2 := range p.cands {
+			if c1 != c2 && p.margin(c1, c2) >= 0 {
+				loser = false
+			}
+		}
+		if loser {
+			return c1, true
+		}
+	}
+	return 0, false
+}
+
+// reachability returns the transitive closure of the given relation: whether
+// there is a chain from c1 to c2 each link of which satisfies rel.
+func reachability(cands []int, rel func(c1, c2 int) bool) map[[2]int]bool {
+	reach := map[[2]int]bool{}
+	for _, c1 := range cands {
+		reach[[2]int{c1, c1}] = true
+		for _, c2 := range cands {
+			if c1 != c2 && rel(c1, c2) {
+				reach[[2]int{c1, c2}] = true
+			}
+		}
+	}
+	for _, c1 := range cands {
+		for _, c2 := range cands {
+			for _, c3 := range cands {
+				if reach[[2]int{c2, c1}] && reach[[2]int{c1, c3}] {
+					reach[[2]int{c2, c3}] = true
+				}
+			}
+		}
+	}
+	return reach
+}
+
+// smithSet returns the smallest set of candidates each of whom beats every
+// candidate outside it: those who can reach every other candidate by a chain
+// of pairwise wins or ties.
+func smithSet(p pairwise) []int {
+	reach := reachability(p.cands, func(c1, c2 int) bool { return p.margin(c1, c2) >= 0 })
+	var ret []int
+	for _, c1 := range p.cands {
+		all := true
+		for _, c2 := range p.cands {
+			if !reach[[2]int{c1, c2}] {
+				all = false
+			}
+		}
+		if all {
+			ret = append(ret, c1)
+		}
+	}
+	return ret
+}
+
+// schwartzSet returns the union of the minimal sets of candidates unbeaten by
+// anyone outside them: those who can reach, by a chain of pairwise wins, every
+// candidate who can reach them.
+func schwartzSet(p pairwise) []int {
+	reach := reachability(p.cands, func(c1, c2 int) bool { return p.margin(c1, c2) > 0 })
+	var ret []int
+	for _, c1 := range p.cands {
+		unbeaten := true
+		for _, c2 := range p.cands {
+			if reach[[2]int{c2, c1}] && !reach[[2]int{c1, c2}] {
+				unbeaten = false
+			}
+		}
+		if unbeaten {
+			ret = append(ret, c1)
+		}
+	}
+	return ret
+}
+
+// formatCondorcetReport describes the Condorcet winner, loser, and sets, and
+// notes if the IRV winner (if it's not 0) disagrees with them.
+func formatCondorcetReport(p pairwise, candidates map[int]string, irvWinner int) string {
+	names := func(ids []int) string {
+		ret := map1(func(id int) string { return candidates[id] }, ids)
+		slices.Sort(ret)
+		return strings.Join(ret, ", ")
+	}
+
+	var buf strings.Builder
+	winner, hasWinner := condorcetWinner(p)
+	if hasWinner {
+		fmt.Fprintln(&buf, "Condorcet winner:", candidates[winner])
+	} else {
+		fmt.Fprintln(&buf, "Condorcet winner: none")
+	}
+	if loser, ok := condorcetLoser(p); ok {
+		fmt.Fprintln(&buf, "Condorcet loser:", candidates[loser])
+	} else {
+		fmt.Fprintln(&buf, "Condorcet loser: none")
+	}
+	smith := smithSet(p)
+	fmt.Fprintln(&buf, "Smith set:", names(smith))
+	fmt.Fprintln(&buf, "Schwartz set:", names(schwartzSet(p)))
+
+	switch {
+	case irvWinner == 0:
+		// no IRV winner to compare
+	case hasWinner && winner != irvWinner:
+		fmt.Fprintf(&buf, "NOTE: IRV winner %v is not the Condorcet winner %v\n",
+			candidates[irvWinner], candidates[winner])
+	case !slices.Contains(smith, irvWinner):
+		fmt.Fprintf(&buf, "NOTE: IRV winner %v is not in the Smith set\n", candidates[irvWinner])
+	}
+	return buf.String()
+}
+
+// runSchulze returns the Schulze ranking, and the strength of the strongest
+// path between each pair of candidates, from which it is derived.
+func runSchulze(p pairwise) (ranking, map[[2]int]int) {
+	prefsMap, cands := p.prefs, p.cands
+
+	pathsMap := map[[2]int]int{}
+	// https://en.wikipedia.org/wiki/Schulze_method#Implementation
+	// d is prefsMap, p is pathsMap, 1..C is cands.
+	for _, c1 := range cands {
+		for _, c2 := range cands {
+			if c1 == c2 {
+				continue
+			}
+
+			if prefsMap[[2]int{c1, c2}] > prefsMap[[2]int{c2, c1}] {
+				pathsMap[[2]int{c1, c2}] = prefsMap[[2]int{c1, c2}]
+			} else {
+				pathsMap[[2]int{c1, c2}] = 0
+			}
+		}
+	}
+
+	for _, c1 := range cands {
+		for _, c2 := range cands {
+			if c1 == c2 {
+				continue
+			}
+			for _, c3 := range cands {
+				if c1 == c3 || c2 == c3 {
+					continue
+				}
+				pathsMap[[2]int{c2, c3}] = max(
+					pathsMap[[2]int{c2, c3}],
+					min(pathsMap[[2]int{c2, c1}], pathsMap[[2]int{c1, c3}]))
+			}
+		}
+	}
+
+	// The relation "c1's strongest path to c2 is stronger than the reverse"
+	// is transitive, so it gives a ranking; candidates neither of which beats
+	// the other are tied.
+	return rankDAG(cands, func(c1, c2 int) bool {
+		return pathsMap[[2]int{c1, c2}] > pathsMap[[2]int{c2, c1}]
+	}), pathsMap
+}
+
+// preferenceGrids lays out the pairwise preferences as a matrix, giving the
+// number of voters who prefer the row candidate to the column candidate, and
+// that as a share of those who prefer one or the other.
+func preferenceGrids(p pairwise, candidates map[int]string, description string) (counts, shares [][]any) {
+	ids := sortedCandidates(onlyCandidates(candidates, p.cands))
+	counts = candidateGrid(description, ids, candidates, func(c1, c2 int) any {
+		if c1 == c2 {
+			return nil
+		}
+		return p.prefs[[2]int{c1, c2}]
+	})
+	shares = candidateGrid(description, ids, candidates, func(c1, c2 int) any {
+		total := p.prefs[[2]int{c1, c2}] + p.prefs[[2]int{c2, c1}]
+		if c1 == c2 || total == 0 {
+			return nil
+		}
+		return float64(p.prefs[[2]int{c1, c2}]) / float64(total)
+	})
+	return counts, shares
+}
+
+func pathGrid(p pairwise, paths map[[2]int]int, candidates map[int]string, description string) [][]any {
+	ids := sortedCandidates(onlyCandidates(candidates, p.cands))
+	return candidateGrid(description, ids, candidates, func(c1, c2 int) any {
+		if c1 == c2 {
+			return nil
+		}
+		return paths[[2]int{c1, c2}]
+	})
+}
+
+func onlyCandidates(candidates map[int]string, ids []int) map[int]string {
+	ret := make(map[int]string, len(ids))
+	for _, id := range ids {
+		ret[id] = candidates[id]
+	}
+	return ret
+}
+
+// runRankedPairs implements Tideman's ranked pairs: lock in pairwise victories
+// from largest margin to smallest, skipping any that would create a cycle.
+// Pairs with equal margins are taken in order of winning votes, then of
+// candidate ID, so the result is deterministic but may depend on that order
+// when margins tie exactly.
+func runRankedPairs(p pairwise) ranking {
+	var pairs [][2]int
+	for _, c1 := range p.cands {
+		for _, c2 := range p.cands {
+			if p.margin(c1, c2) > 0 {
+				pairs = append(pairs, [2]int{c1, c2})
+			}
+		}
+	}
+	slices.SortStableFunc(pairs, func(x, y [2]int) bool {
+		if mx, my := p.margin(x[0], x[1]), p.margin(y[0], y[1]); mx != my {
+			return mx > my
+		}
+		return p.prefs[x] > p.prefs[y]
+	})
+
+	locked := map[[2]int]bool{}
+	// reaches reports whether there's a path of locked pairs from c1 to c2.
+	var reaches func(c1, c2 int, seen map[int]bool) bool
+	reaches = func(c1, c2 int, seen map[int]bool) bool {
+		if c1 == c2 {
+			return true
+		}
+		seen[c1] = true
+		for _, c3 := range p.cands {
+			if !seen[c3] && locked[[2]int{c1, c3}] && reaches(c3, c2, seen) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, pair := range pairs {
+		if !reaches(pair[1], pair[0], map[int]bool{}) {
+			locked[pair] = true
+		}
+	}
+
+	return rankDAG(p.cands, func(c1, c2 int) bool { return reaches(c1, c2, map[int]bool{}) })
+}
+
+// runMinimax ranks candidates by their worst pairwise defeat, measured by
+// margin: the candidate whose largest loss is smallest wins.
+func runMinimax(p pairwise) ranking {
+	score := make(map[int]int, len(p.cands))
+	for _, c1 := range p.cands {
+		worst := 0
+		for _, c2 := range p.cands {
+			if c1 != c2 && p.margin(c2, c1) > worst {
+				worst = p.margin(c2, c1)
+			}
+		}
+		score[c1] = -worst
+	}
+	return rankByScore(p.cands, score)
+}
+
+// runCopeland ranks candidates by pairwise wins, with a pairwise tie counting
+// as half a win.
+func runCopeland(p pairwise) ranking {
+	score := make(map[int]float64, len(p.cands))
+	for _, c1 := range p.cands {
+		for _, c2 := range p.cands {
+			switch {
+			case c1 == c2:
+			case p.margin(c1, c2) > 0:
+				score[c1]++
+			case p.margin(c1, c2) == 0:
+				score[c1] += 0.5
+			}
+		}
+	}
+	return rankByScore(p.cands, score)
+}
+
+// maxKemenyCandidates bounds the number of candidates for which we compute
+// Kemeny-Young, which takes time factorial in that number.
+const maxKemenyCandidates = 9
+
+// runKemenyYoung finds the ordering of candidates that agrees with the most
+// pairwise preferences, by trying every ordering. If several are optimal,
+// candidates are ranked by their average position among them, and the second
+// return value is the number of optimal orderings. It returns nil if there are
+// too many candidates.
+func runKemenyYoung(p pairwise) (ranking, int) {
+	if len(p.cands) > maxKemenyCandidates {
+		return nil, 0
+	}
+
+	best := -1
+	var optimal [][]int
+	perm := slices.Clone(p.cands)
+	var permute func(k, score int)
+	permute = func(k, score int) {
+		if k == len(perm) {
+			if score > best {
+				best = score
+				optimal = nil
+			}
+			if score == best {
+				optimal = append(optimal, slices.Clone(perm))
+			}
+			return
+		}
+		for i := k; i < len(perm); i++ {
+			perm[k], perm[i] = perm[i], perm[k]
+			// perm[k] goes after everything before it, so add those
+			// preferences now.
+			added := 0
+			for _, c := range perm[:k] {
+				added += p.prefs[[2]int{c, perm[k]}]
+			}
+			permute(k+1, score+added)
+			perm[k], perm[i] = perm[i], perm[k]
+		}
+	}
+	permute(0, 0)
+
+	position := make(map[int]float64, len(p.cands))
+	for _, ordering := range optimal {
+		for i, c := range ordering {
+			position[c] -= float64(i)
+		}
+	}
+	return rankByScore(p.cands, position), len(optimal)
+}
+
+type CondorcetResult struct {
+	Winner   *CandidateInfo  `json:"winner"` // null if there's none
+	Loser    *CandidateInfo  `json:"loser"`  // null if there's none
+	Smith    []CandidateInfo `json:"smith"`
+	Schwartz []CandidateInfo `json:"schwartz"`
+}
+
+func condorcetResult(p pairwise, names candidateNames) CondorcetResult {
+	ret := CondorcetResult{
+		Smith:    names.sorted(smithSet(p)),
+		Schwartz: names.sorted(schwartzSet(p)),
+	}
+	if winner, ok := condorcetWinner(p); ok {
+		info := names.info(winner)
+		ret.Winner = &info
+	}
+	if loser, ok := condorcetLoser(p); ok {
+		info := names.info(loser)
+		ret.Loser = &info
+	}
+	return ret
+}
+
+// Preference is how many voters prefer one candidate to another.
+type Preference struct {
+	For     CandidateInfo `json:"for"`
+	Against CandidateInfo `json:"against"`
+	Count   int           `json:"count"`
+	// the strength of the strongest path from For to Against, for Schulze
+	StrongestPath int `json:"strongestPath"`
+}
+
+func preferences(p pairwise, paths map[[2]int]int, names candidateNames) []Preference {
+	ids := sortedCandidates(onlyCandidates(names.short, p.cands))
+	var ret []Preference
+	for _, c1 := range ids {
+		for _, c2 := range ids {
+			if c1 != c2 {
+				ret = append(ret, Preference{
+					For:           names.info(c1),
+					Against:       names.info(c2),
+					Count:         p.prefs[[2]int{c1, c2}],
+					StrongestPath: paths[[2]int{c1, c2}],
+				})
+			}
+		}
+	}
+	return ret
+}
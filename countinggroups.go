@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// countingGroups returns the IDs of the counting groups (vote-by-mail,
+// election day, etc.) with any ballots, in order. It reads the ballots only
+// the first time.
+func countingGroups(b *BallotData) []int {
+	if b.countingGroupIDs == nil {
+		seen := map[int]bool{}
+		b.forEachBallot(func(ballot *Ballot) { seen[ballot.CountingGroupID] = true })
+		b.countingGroupIDs = maps.Keys(seen)
+		slices.Sort(b.countingGroupIDs)
+	}
+	return b.countingGroupIDs
+}
+
+func countingGroupName(b *BallotData, id int) string {
+	if cg, ok := b.CountingGroups[id]; ok {
+		return cg.Description
+	}
+	return "Counting group " + strconv.Itoa(id)
+}
+
+func countingGroupInfo(b *BallotData, id int) *CountingGroupInfo {
+	return &CountingGroupInfo{ID: id, Description: countingGroupName(b, id)}
+}
+
+// ByCountingGroup returns a view of the data for each counting group, by
+// counting group ID.
+func ByCountingGroup(b *BallotData) map[int]*BallotData {
+	ret := map[int]*BallotData{}
+	for _, id := range countingGroups(b) {
+		id := id
+		ret[id] = b.Filter(func(ballot *Ballot) bool { return ballot.CountingGroupID == id })
+	}
+	return ret
+}
+
+// CountingGroupShiftsResult compares each candidate's share of the vote
+// (first choices, for RCV) in each counting group with their share overall.
+type CountingGroupShiftsResult struct {
+	resultHeader
+	Contest ContestInfo         `json:"contest"`
+	Groups  []CountingGroupInfo `json:"groups"`
+	Ballots int                 `json:"ballots"`
+	// in the order of Groups
+	GroupBallots []int `json:"groupBallots"`
+	// sorted by name
+	Candidates []CandidateShares `json:"candidates"`
+}
+
+// CandidateShares are a candidate's shares of the vote, each from 0 to 1.
+type CandidateShares struct {
+	CandidateInfo
+	Share float64 `json:"share"`
+	// in the order of Groups
+	GroupShares []float64 `json:"groupShares"`
+	// between the groups where the candidate did best and worst
+	Spread float64 `json:"spread"`
+}
+
+// CountingGroupShifts compares each candidate's share of the vote in each
+// counting group with their share overall.
+func CountingGroupShifts(b *BallotData, contestID int, rules rcvBallotRules) *CountingGroupShiftsResult {
+	groups := countingGroups(b)
+	tallies := groupedTallies(b, contestID, rules, func(ballot *Ballot) int { return ballot.CountingGroupID })
+	overall := &contestTally{votes: map[int]int{}}
+	for _, tally := range tallies {
+		overall.ballots += tally.ballots
+		for id, votes := range tally.votes {
+			overall.votes[id] += votes
+		}
+	}
+	share := func(tally *contestTally, id int) float64 {
+		if tally == nil {
+			return 0
+		}
+		total := 0
+		for _, votes := range tally.votes {
+			total += votes
+		}
+		if total == 0 {
+			return 0
+		}
+		return float64(tally.votes[id]) / float64(total)
+	}
+
+	ret := &CountingGroupShiftsResult{
+		resultHeader: resultHeader{Type: "countingGroupShifts"},
+		Contest:      contestInfo(b, contestID),
+		Ballots:      overall.ballots,
+	}
+	for _, group := range groups {
+		ret.Groups = append(ret.Groups, *countingGroupInfo(b, group))
+		n := 0
+		if tally, ok := tallies[group]; ok {
+			n = tally.ballots
+		}
+		ret.GroupBallots = append(ret.GroupBallots, n)
+	}
+
+	names := contestCandidateNames(b, contestID)
+	for _, id := range sortedCandidates(names.short) {
+		c := CandidateShares{CandidateInfo: names.info(id), Share: share(overall, id)}
+		lo, hi := 1.0, 0.0
+		for _, group := range groups {
+			s := share(tallies[group], id)
+			lo, hi = min(lo, s), max(hi, s)
+			c.GroupShares = append(c.GroupShares, s)
+		}
+		c.Spread = max(hi-lo, 0)
+		ret.Candidates = append(ret.Candidates, c)
+	}
+	return ret
+}
+
+// Text lays out the shares in percent, and each group's shift from overall
+// in percentage points. The last column is the spread between the groups.
+func (r *CountingGroupShiftsResult) Text() string {
+	header := []string{"", "All"}
+	ballots := []string{"Ballots", strconv.Itoa(r.Ballots)}
+	for i, group := range r.Groups {
+		header = append(header, group.Description)
+		ballots = append(ballots, strconv.Itoa(r.GroupBallots[i]))
+	}
+	table := [][]string{append(header, "Spread"), append(ballots, "")}
+	for _, c := range r.Candidates {
+		row := []string{c.Name, fmt.Sprintf("%.1f%%", 100*c.Share)}
+		for _, s := range c.GroupShares {
+			row = append(row, fmt.Sprintf("%.1f%% (%+.1f)", 100*s, 100*(s-c.Share)))
+		}
+		table = append(table, append(row, fmt.Sprintf("%.1f", 100*c.Spread)))
+	}
+	return "Shift by counting group (percentage points from overall)\n" + formatTable(table) + "\n"
+}
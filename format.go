@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 )
 
@@ -27,6 +28,10 @@ func cmpOne(x, y string) int {
 		return -1
 	case x == "Abs" || x == "Abstain":
 		return 1
+	case y == "Overvote":
+		return -1
+	case x == "Overvote":
+		return 1
 	case y == "Exhausted":
 		return -1
 	case x == "Exhausted":
@@ -110,8 +115,8 @@ func formatCSV(results map[string]int) string {
 	return buf.String()
 }
 
-func formatGrid[T any](grid [][]T) string {
-	strings := map1(func(row []T) []string {
+func gridStrings[T any](grid [][]T) [][]string {
+	return map1(func(row []T) []string {
 		return map1(func(cell T) string {
 			if interface{}(cell) == nil {
 				return ""
@@ -119,6 +124,10 @@ func formatGrid[T any](grid [][]T) string {
 			return fmt.Sprint(cell)
 		}, row)
 	}, grid)
+}
+
+func formatGrid[T any](grid [][]T) string {
+	strings := gridStrings(grid)
 	var buf bytes.Buffer
 	w := csv.NewWriter(&buf)
 	err := w.WriteAll(strings)
@@ -128,6 +137,41 @@ func formatGrid[T any](grid [][]T) string {
 	return buf.String()
 }
 
+func sortedCandidates(candidates map[int]string) []int {
+	ids := maps.Keys(candidates)
+	slices.Sort(ids) // candidates with the same name go in order of ID
+	slices.SortStableFunc(ids, func(i, j int) bool { return less(candidates[i], candidates[j]) })
+	return ids
+}
+
+// candidateGrid lays out a candidate-by-candidate matrix in the style of
+// GridChart, with the value of each cell given by cell(row, column).
+func candidateGrid(description string, ids []int, candidates map[int]string, cell func(c1, c2 int) any) [][]any {
+	n := len(ids)
+	ret := make([][]any, n+2)
+	ret[0] = make([]any, n+2)
+	ret[1] = make([]any, n+2)
+	for j, id := range ids {
+		ret[0][j+2] = description
+		ret[1][j+2] = candidates[id]
+	}
+	for i, c1 := range ids {
+		ret[i+2] = make([]any, n+2)
+		ret[i+2][0] = description
+		ret[i+2][1] = candidates[c1]
+		for j, c2 := range ids {
+			ret[i+2][j+2] = cell(c1, c2)
+		}
+	}
+	return ret
+}
+
+// formatCandidateGrid formats a grid from candidateGrid as plain text, without
+// the contest descriptions.
+func formatCandidateGrid(grid [][]any) string {
+	return formatTable(map1(func(row []string) []string { return row[1:] }, gridStrings(grid[1:])))
+}
+
 type color [3]uint8
 
 var (
@@ -236,3 +280,58 @@ func formatGridHTML[T any](grid [][]T) string {
 	b.WriteString("</tbody>\n</table>\n")
 	return b.String()
 }
+
+func formatTopResults(results map[string]int, n int) string {
+	keys := maps.Keys(results)
+	slices.SortFunc(keys, func(x, y string) bool {
+		if results[x] != results[y] {
+			return results[x] > results[y]
+		}
+		return less(x, y)
+	})
+	total := sum(maps.Values(results))
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+
+	w := 0
+	for _, k := range keys {
+		if w < len(k) {
+			w = len(k)
+		}
+	}
+	f := "%" + strconv.Itoa(w) + "v"
+	var buf strings.Builder
+	for i, k := range keys {
+		fmt.Fprintf(&buf, "%3d. "+f+": %7v (%4.1f%%)\n",
+			i+1, k, results[k], float64(100*results[k])/float64(total))
+	}
+	return buf.String()
+}
+
+// formatTable lays out a grid as plain text, with columns padded to line up.
+func formatTable(grid [][]string) string {
+	var ws []int
+	for _, row := range grid {
+		for j, cell := range row {
+			if j == len(ws) {
+				ws = append(ws, 0)
+			}
+			if ws[j] < len(cell) {
+				ws[j] = len(cell)
+			}
+		}
+	}
+
+	var buf strings.Builder
+	for _, row := range grid {
+		for j, cell := range row {
+			if j > 0 {
+				buf.WriteString("  ")
+			}
+			fmt.Fprintf(&buf, "%"+strconv.Itoa(ws[j])+"v", cell)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Precinct maps: we join a GeoJSON file of precinct boundaries to the results
+// on RawPrecinct.ExternalID.
+
+type geoFeatureCollection struct {
+	Type     string        `json:"type"`
+	Features []*geoFeature `json:"features"`
+	// other members, like crs and bbox, to write back as they were
+	other map[string]json.RawMessage
+}
+
+type geoFeature struct {
+	Type       string          `json:"type"`
+	ID         any             `json:"id,omitempty"`
+	Properties map[string]any  `json:"properties"`
+	Geometry   json.RawMessage `json:"geometry"`
+	other      map[string]json.RawMessage
+}
+
+func (fc *geoFeatureCollection) UnmarshalJSON(data []byte) error {
+	type plain geoFeatureCollection
+	return unmarshalGeoObject(data, (*plain)(fc), &fc.other)
+}
+
+func (fc *geoFeatureCollection) MarshalJSON() ([]byte, error) {
+	type plain geoFeatureCollection
+	return marshalGeoObject((*plain)(fc), fc.other)
+}
+
+func (f *geoFeature) UnmarshalJSON(data []byte) error {
+	type plain geoFeature
+	return unmarshalGeoObject(data, (*plain)(f), &f.other)
+}
+
+func (f *geoFeature) MarshalJSON() ([]byte, error) {
+	type plain geoFeature
+	return marshalGeoObject((*plain)(f), f.other)
+}
+
+// unmarshalGeoObject decodes a GeoJSON object into known, and whatever
+// members known doesn't have a field for into other.
+func unmarshalGeoObject(data []byte, known any, other *map[string]json.RawMessage) error {
+	err := json.Unmarshal(data, known)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, other)
+	if err != nil {
+		return err
+	}
+	for _, name := range geoMemberNames(known) {
+		delete(*other, name)
+	}
+	return nil
+}
+
+// marshalGeoObject encodes known's fields along with the other members.
+func marshalGeoObject(known any, other map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(known)
+	if err != nil || len(other) == 0 {
+		return data, err
+	}
+	members := maps.Clone(other)
+	err = json.Unmarshal(data, &members)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(members)
+}
+
+// geoMemberNames returns the JSON names of a struct's fields.
+func geoMemberNames(v any) []string {
+	t := reflect.TypeOf(v).Elem()
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+type geoGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+func loadGeoJSON(filename string) (*geoFeatureCollection, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var fc geoFeatureCollection
+	err = json.Unmarshal(data, &fc)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", filename, err)
+	}
+	if fc.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("%v: expected a FeatureCollection, got %q", filename, fc.Type)
+	}
+	return &fc, nil
+}
+
+// geoKey formats a property value for joining: GeoJSON files variously store
+// precinct IDs as strings or numbers.
+func geoKey(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// guessGeoKey picks the feature property whose values match the most
+// precinct external IDs.
+func guessGeoKey(fc *geoFeatureCollection, externalIDs map[string]int) (string, error) {
+	matches := map[string]int{}
+	for _, f := range fc.Features {
+		for k, v := range f.Properties {
+			if _, ok := externalIDs[geoKey(v)]; ok {
+				matches[k]++
+			}
+		}
+	}
+	keys := maps.Keys(matches)
+	if len(keys) == 0 {
+		return "", fmt.Errorf("no GeoJSON property matches any precinct ID")
+	}
+	slices.SortFunc(keys, func(k1, k2 string) bool {
+		return matches[k1] > matches[k2] || matches[k1] == matches[k2] && k1 < k2
+	})
+	return keys[0], nil
+}
+
+// precinctMapData is the result of joining the results of a contest to
+// precinct boundaries.
+type precinctMapData struct {
+	description string
+	features    *geoFeatureCollection
+	candidates  map[int]string
+	// feature index -> precinct name and tally, for features that joined
+	names   map[int]string
+	tallies map[int]*contestTally
+	// features whose key matched no precinct
+	unmatchedFeatures []string
+	// precincts with ballots for the contest but no feature, and how many
+	unmatchedPrecincts []string
+	unmatchedBallots   int
+	// ballots for the contest from precinct portions or precincts not in the
+	// manifest, which can't be on the map
+	unknownBallots int
+}
+
+// JoinPrecinctMap joins the results of a contest to the features of a GeoJSON
+// file, on the given property (or the best guess, if key is empty), and
+// attaches the results to the features' properties, under the prefix
+// "results." so as not to overwrite any: the ballots, undervotes, overvotes,
+// and leading candidate, and each candidate's votes and share of the votes.
+func JoinPrecinctMap(b *BallotData, contestID int, rules rcvBallotRules, fc *geoFeatureCollection, key string) (*precinctMapData, error) {
+	externalIDs := make(map[string]int, len(b.Precincts))
+	for id, p := range b.Precincts {
+		externalIDs[p.ExternalID] = id
+	}
+	if key == "" {
+		var err error
+		key, err = guessGeoKey(fc, externalIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tallies := groupedTallies(b, contestID, rules, func(ballot *Ballot) int {
+		if pp, ok := b.PrecinctPortions[ballot.PrecinctPortionID]; ok {
+			if _, ok := b.Precincts[pp.PrecinctID]; ok {
+				return pp.PrecinctID
+			}
+		}
+		return 0
+	})
+	names := fullNames(b, contestID)
+	ids := sortedCandidates(names)
+
+	ret := &precinctMapData{
+		description: b.Contests[contestID].Description,
+		features:    fc,
+		candidates:  names,
+		names:       map[int]string{},
+		tallies:     map[int]*contestTally{},
+	}
+	joined := map[int]bool{}
+	for i, f := range fc.Features {
+		k := geoKey(f.Properties[key])
+		precinctID, ok := externalIDs[k]
+		if !ok {
+			ret.unmatchedFeatures = append(ret.unmatchedFeatures, k)
+			continue
+		}
+		joined[precinctID] = true
+		tally, ok := tallies[precinctID]
+		if !ok {
+			tally = &contestTally{votes: map[int]int{}}
+		}
+		ret.names[i] = b.Precincts[precinctID].Description
+		ret.tallies[i] = tally
+
+		if f.Properties == nil {
+			f.Properties = map[string]any{}
+		}
+		total := sum(maps.Values(tally.votes))
+		f.Properties["results.contest"] = ret.description
+		f.Properties["results.ballots"] = tally.ballots
+		f.Properties["results.undervotes"] = tally.undervotes
+		f.Properties["results.overvotes"] = tally.overvotes
+		if leader := tally.leader(); leader != 0 {
+			f.Properties["results.leader"] = names[leader]
+		}
+		for _, id := range ids {
+			f.Properties["results.votes."+names[id]] = tally.votes[id]
+			share := 0.0
+			if total > 0 {
+				share = float64(tally.votes[id]) / float64(total)
+			}
+			f.Properties["results.share."+names[id]] = math.Round(share*10000) / 10000
+		}
+	}
+
+	for id, p := range b.Precincts {
+		if tally, ok := tallies[id]; ok && !joined[id] {
+			ret.unmatchedPrecincts = append(ret.unmatchedPrecincts, p.ExternalID)
+			ret.unmatchedBallots += tally.ballots
+		}
+	}
+	if tally, ok := tallies[0]; ok {
+		ret.unknownBallots = tally.ballots
+	}
+	slices.Sort(ret.unmatchedFeatures)
+	slices.Sort(ret.unmatchedPrecincts)
+	return ret, nil
+}
+
+// leader returns the candidate with the most votes, or 0 if there are none or
+// there's a tie.
+func (t *contestTally) leader() int {
+	leader, best, tied := 0, 0, false
+	for id, votes := range t.votes {
+		switch {
+		case votes > best:
+			leader, best, tied = id, votes, false
+		case votes == best && votes > 0:
+			tied = true
+		}
+	}
+	if tied {
+		return 0
+	}
+	return leader
+}
+
+func (m *precinctMapData) formatUnmatched() string {
+	var buf bytes.Buffer
+	if len(m.unmatchedPrecincts) > 0 {
+		fmt.Fprintf(&buf, "%v precincts with %v ballots not on the map: %v\n",
+			len(m.unmatchedPrecincts), m.unmatchedBallots, m.unmatchedPrecincts)
+	}
+	if m.unknownBallots > 0 {
+		fmt.Fprintf(&buf, "%v ballots from unknown precincts not on the map\n", m.unknownBallots)
+	}
+	if len(m.unmatchedFeatures) > 0 {
+		fmt.Fprintf(&buf, "%v map features not matching any precinct: %q\n",
+			len(m.unmatchedFeatures), m.unmatchedFeatures)
+	}
+	return buf.String()
+}
+
+const (
+	mapSize   = 800
+	mapMargin = 20
+)
+
+// geoRings returns the polygon rings of a Polygon or MultiPolygon geometry,
+// as lists of [longitude, latitude]; we ignore other geometry types.
+func geoRings(raw json.RawMessage) ([][][2]float64, error) {
+	var g geoGeometry
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	err := json.Unmarshal(raw, &g)
+	if err != nil {
+		return nil, err
+	}
+	switch g.Type {
+	case "Polygon":
+		var rings [][][2]float64
+		err = json.Unmarshal(g.Coordinates, &rings)
+		return rings, err
+	case "MultiPolygon":
+		var polygons [][][][2]float64
+		err = json.Unmarshal(g.Coordinates, &polygons)
+		var rings [][][2]float64
+		for _, polygon := range polygons {
+			rings = append(rings, polygon...)
+		}
+		return rings, err
+	default:
+		return nil, nil
+	}
+}
+
+// formatChoroplethHTML draws the map as a standalone HTML page with an inline
+// SVG, coloring each precinct by its leading candidate, darker the larger
+// their share of the vote.
+func (m *precinctMapData) formatChoroplethHTML() (string, error) {
+	rings := make([][][][2]float64, len(m.features.Features))
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for i, f := range m.features.Features {
+		var err error
+		rings[i], err = geoRings(f.Geometry)
+		if err != nil {
+			return "", err
+		}
+		for _, ring := range rings[i] {
+			for _, pt := range ring {
+				minX, maxX = math.Min(minX, pt[0]), math.Max(maxX, pt[0])
+				minY, maxY = math.Min(minY, pt[1]), math.Max(maxY, pt[1])
+			}
+		}
+	}
+	if minX > maxX {
+		return "", fmt.Errorf("no polygons to draw")
+	}
+
+	// equirectangular, scaled for the latitude, with north up
+	aspect := math.Cos((minY + maxY) / 2 * math.Pi / 180)
+	if maxY == minY && maxX == minX || aspect <= 0 {
+		aspect = 1
+	}
+	scale := (mapSize - 2*mapMargin) / math.Max((maxX-minX)*aspect, maxY-minY)
+	width := (maxX-minX)*aspect*scale + 2*mapMargin
+	height := (maxY-minY)*scale + 2*mapMargin
+	project := func(pt [2]float64) (float64, float64) {
+		return (pt[0]-minX)*aspect*scale + mapMargin, (maxY-pt[1])*scale + mapMargin
+	}
+
+	ids := sortedCandidates(m.candidates)
+	color := map[int]string{}
+	for i, id := range ids {
+		color[id] = sankeyColors[i%len(sankeyColors)]
+	}
+
+	var b bytes.Buffer
+	title := html.EscapeString(m.description)
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n", title)
+	fmt.Fprintf(&b, "<h1>%s</h1>\n", title)
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" font-family="sans-serif" font-size="12">`+"\n",
+		width, height)
+	for i := range m.features.Features {
+		if len(rings[i]) == 0 {
+			continue
+		}
+		var d bytes.Buffer
+		for _, ring := range rings[i] {
+			for j, pt := range ring {
+				x, y := project(pt)
+				fmt.Fprintf(&d, "%s%.1f,%.1f", ternary(j == 0, "M", "L"), x, y)
+			}
+			d.WriteString("Z")
+		}
+
+		fill, opacity, label := "#ffffff", 1.0, "no data"
+		if tally, ok := m.tallies[i]; ok {
+			label = strconv.Itoa(tally.ballots) + " ballots"
+			total := sum(maps.Values(tally.votes))
+			if leader := tally.leader(); leader != 0 {
+				share := float64(tally.votes[leader]) / float64(total)
+				fill, opacity = color[leader], 0.2+0.8*share
+				label = fmt.Sprintf("%s %.1f%%, %s", m.candidates[leader], 100*share, label)
+			} else if total > 0 {
+				fill, label = "#999999", "tied, "+label
+			}
+		}
+		if name, ok := m.names[i]; ok {
+			label = name + ": " + label
+		}
+		fmt.Fprintf(&b, `<path d="%s" fill="%s" fill-opacity="%.2f" stroke="#333333" stroke-width="0.5" fill-rule="evenodd"><title>%s</title></path>`+"\n",
+			d.String(), fill, opacity, html.EscapeString(label))
+	}
+	b.WriteString("</svg>\n<p>\n")
+	for _, id := range ids {
+		fmt.Fprintf(&b, `<span style="background:%s">&nbsp;&nbsp;&nbsp;</span> %s&nbsp;&nbsp;`+"\n",
+			color[id], html.EscapeString(m.candidates[id]))
+	}
+	b.WriteString("</p>\n</body>\n</html>\n")
+	return b.String(), nil
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// rcvBallot is a ranked ballot as it will be tabulated: the candidates it
+// ranks, in order, and whether it ends in an overvote (in which case it is
+// counted as an overvote, rather than exhausted, once they are all
+// eliminated).
+type rcvBallot struct {
+	ranks     []int
+	overvoted bool
+}
+
+func rankings(ballots []rcvBallot) [][]int {
+	return map1(func(ballot rcvBallot) []int { return ballot.ranks }, ballots)
+}
+
+type irvTieBreak int
+
+const (
+	// Break ties by lot, using irvRules.drawOrder.
+	tieBreakDraw irvTieBreak = iota
+	// Break ties by the tied candidates' votes in the most recent round in
+	// which they differed, falling back to drawOrder.
+	tieBreakPriorRound
+)
+
+func (t irvTieBreak) String() string {
+	switch t {
+	case tieBreakDraw:
+		return "draw"
+	case tieBreakPriorRound:
+		return "prior"
+	default:
+		return "irvTieBreak(" + strconv.Itoa(int(t)) + ")"
+	}
+}
+
+func parseTieBreak(s string) (irvTieBreak, error) {
+	for _, t := range []irvTieBreak{tieBreakDraw, tieBreakPriorRound} {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown tie-break %q", s)
+}
+
+type irvRules struct {
+	// Eliminate at once every candidate who is mathematically defeated, i.e.
+	// whose votes combined with those of all candidates below them are fewer
+	// than those of the next candidate up.
+	batchElimination bool
+	tieBreak         irvTieBreak
+	// Candidate IDs in the order drawn to lose ties: the first one listed
+	// loses a tie to any other. Candidates not listed lose ties to those that
+	// are, and among themselves go in order of ID.
+	drawOrder []int
+	// Keep eliminating until only two candidates remain, even if one already
+	// has a majority of continuing ballots.
+	untilTwo bool
+}
+
+// SF's rules: RCV Tabulation Manual, and Charter §13.102.
+var sfIRVRules = irvRules{
+	batchElimination: true,
+	tieBreak:         tieBreakDraw,
+}
+
+// Pseudo-candidate IDs, for where ballots go when they stop counting for
+// anyone.
+const (
+	exhaustedID = -1
+	overvoteID  = -2
+)
+
+type irvRoundResults struct {
+	topChoices map[string]int // by name, including exhausted and overvotes
+	tallies    map[int]int    // candidate ID -> votes, for continuing candidates
+	exhausted  int            // ballots with no continuing candidate left
+	overvotes  int            // ballots that reached an overvote
+	eliminated []int
+	// eliminated candidate ID -> candidate ID, exhaustedID, or overvoteID ->
+	// votes transferred there in the next round
+	transfers map[int]map[int]int
+	winner    int // candidate ID, or 0 if this isn't the last round
+	// continuing candidates from last place to first, ties broken as by
+	// irvRules.tieBreak
+	order []int
+}
+
+func (r irvRoundResults) continuing() int {
+	return sum(maps.Values(r.tallies))
+}
+
+// runIRV tabulates the ballots by IRV, returning each round's results. It
+// returns no rounds if no ballot counts for any candidate, as when there are
+// no candidates or no ballots.
+func runIRV(ballots []rcvBallot, candidates map[int]string, rules irvRules) []irvRoundResults {
+	drawIndex := make(map[int]int, len(candidates))
+	for i, id := range rules.drawOrder {
+		drawIndex[id] = i - len(rules.drawOrder)
+	}
+	ids := maps.Keys(candidates)
+	slices.Sort(ids)
+	for i, id := range ids {
+		if _, ok := drawIndex[id]; !ok {
+			drawIndex[id] = i
+		}
+	}
+
+	var results []irvRoundResults
+	continuing := make(map[int]bool, len(candidates))
+	for id := range candidates {
+		continuing[id] = true
+	}
+	// positions[i] is the index in ballots[i].ranks of the candidate it
+	// counts for, or len(ballots[i].ranks) if it's exhausted.
+	positions := make([]int, len(ballots))
+
+	// loses reports whether c1 goes below c2 in the current round.
+	loses := func(tallies map[int]int, c1, c2 int) bool {
+		if tallies[c1] != tallies[c2] {
+			return tallies[c1] < tallies[c2]
+		}
+		if rules.tieBreak == tieBreakPriorRound {
+			for i := len(results) - 1; i >= 0; i-- {
+				prior := results[i].tallies
+				if prior[c1] != prior[c2] {
+					return prior[c1] < prior[c2]
+				}
+			}
+		}
+		return drawIndex[c1] < drawIndex[c2]
+	}
+
+	for {
+		round := irvRoundResults{
+			topChoices: map[string]int{},
+			tallies:    make(map[int]int, len(continuing)),
+		}
+		for id := range continuing {
+			round.tallies[id] = 0
+		}
+		for i, ballot := range ballots {
+			if len(ballot.ranks) == 0 && !ballot.overvoted {
+				continue // blank ballots don't count at all
+			}
+			from := 0
+			if positions[i] < len(ballot.ranks) && !continuing[ballot.ranks[positions[i]]] {
+				// eliminated last round
+				from = ballot.ranks[positions[i]]
+			}
+			for positions[i] < len(ballot.ranks) && !continuing[ballot.ranks[positions[i]]] {
+				positions[i]++
+			}
+			to := exhaustedID
+			switch {
+			case positions[i] < len(ballot.ranks):
+				to = ballot.ranks[positions[i]]
+				round.tallies[to]++
+			case ballot.overvoted:
+				to = overvoteID
+				round.overvotes++
+			default:
+				round.exhausted++
+			}
+			if from != 0 {
+				results[len(results)-1].transfers[from][to]++
+			}
+		}
+
+		for id, votes := range round.tallies {
+			round.topChoices[candidates[id]] = votes
+		}
+		if round.exhausted > 0 {
+			round.topChoices[exhausted] = round.exhausted
+		}
+		if round.overvotes > 0 {
+			round.topChoices[overvoted] = round.overvotes
+		}
+
+		if round.continuing() == 0 {
+			// only possible in the first round: the leader keeps their votes
+			return nil
+		}
+		order := maps.Keys(round.tallies)
+		slices.SortFunc(order, func(c1, c2 int) bool { return loses(round.tallies, c1, c2) })
+		round.order = order
+		leader := order[len(order)-1]
+		if len(order) == 1 ||
+			rules.untilTwo && len(order) == 2 ||
+			!rules.untilTwo && 2*round.tallies[leader] > round.continuing() {
+			round.winner = leader
+			return append(results, round)
+		}
+
+		n := 1
+		if rules.batchElimination {
+			below := 0
+			for k := 0; k < len(order)-2; k++ {
+				below += round.tallies[order[k]]
+				if below < round.tallies[order[k+1]] {
+					n = k + 1
+				}
+			}
+		}
+		round.eliminated = order[:n]
+		round.transfers = make(map[int]map[int]int, n)
+		for _, id := range round.eliminated {
+			delete(continuing, id)
+			round.transfers[id] = map[int]int{}
+		}
+		results = append(results, round)
+	}
+}
+
+func formatIRVRound(round irvRoundResults, candidates map[int]string) string {
+	var buf strings.Builder
+	buf.WriteString(formatResults(round.topChoices))
+	continuing := round.continuing()
+	fmt.Fprintf(&buf, "%v continuing ballots, %v needed to win\n", continuing, continuing/2+1)
+	if round.winner != 0 {
+		fmt.Fprintln(&buf, candidates[round.winner], "wins")
+	} else {
+		names := map1(func(id int) string { return candidates[id] }, round.eliminated)
+		fmt.Fprintln(&buf, strings.Join(names, ", "),
+			ternary(len(names) == 1, "is eliminated", "are eliminated"))
+	}
+	return buf.String()
+}
+
+// irvMargin bounds the margin of victory of an IRV tabulation: the smallest
+// number of ballots that would have to change to change the winner.
+type irvMargin struct {
+	lower, upper int
+	// The round (0-indexed) and pair of candidates on which each bound
+	// hinges.
+	lowerRound, upperRound int
+	lowerPair, upperPair   [2]int
+}
+
+// irvMarginBounds estimates the margin of victory, from the winner and
+// elimination order. (Computing it exactly is NP-hard in general.)
+//
+// For the lower bound: any change in outcome must first change what happens
+// in some round -- who is eliminated, or whether someone wins -- and changing
+// k ballots can narrow the gap between two candidates, or groups of
+// candidates, by at most 2k.
+//
+// For the upper bound: in some round, take ballots counting for the winner
+// and swap the winner with the weakest other candidate, until the winner is
+// the weakest. That usually eliminates the winner, but the swapped ballots
+// also count in earlier rounds, where they can change the path to that round
+// instead, so we retabulate with the changed ballots, and only count it if the
+// winner does change. We try the rounds from the fewest ballots up, and if
+// none works, there's no upper bound.
+func irvMarginBounds(ballots []rcvBallot, candidates map[int]string, rounds []irvRoundResults, rules irvRules) irvMargin {
+	ret := irvMargin{lower: -1, upper: -1}
+	if len(rounds) == 0 {
+		return ret
+	}
+	final := rounds[len(rounds)-1]
+	winner := final.winner
+
+	lowerBound := func(round int, need int, pair [2]int) {
+		need = max(need, 1)
+		if ret.lower == -1 || need < ret.lower {
+			ret.lower, ret.lowerRound, ret.lowerPair = need, round, pair
+		}
+	}
+	// flip returns the number of ballots needed to flip a > b to a <= b, or
+	// vice versa, where d = a - b.
+	flip := func(d int) int {
+		if d > 0 {
+			return (d + 1) / 2
+		}
+		return -d/2 + 1
+	}
+
+	type change struct{ round, need, weakest int }
+	var changes []change
+	for r, round := range rounds {
+		order := round.order
+		continuing := round.continuing()
+		n := len(order)
+		leader := order[n-1]
+
+		if r == len(rounds)-1 {
+			switch {
+			case n == 1:
+			case rules.untilTwo && n == 2:
+				lowerBound(r, flip(round.tallies[winner]-round.tallies[order[0]]), [2]int{winner, order[0]})
+			default:
+				lowerBound(r, flip(2*round.tallies[winner]-continuing),
+					[2]int{winner, ternary(leader == winner, order[n-2], leader)})
+			}
+		} else {
+			if !rules.untilTwo && leader != winner {
+				// leader could win here instead
+				lowerBound(r, flip(2*round.tallies[leader]-continuing), [2]int{leader, winner})
+			}
+			below := 0
+			for j := 1; j <= n-2 || j == 1; j++ {
+				below += round.tallies[order[j-1]]
+				if !rules.batchElimination && j > 1 || j < len(round.eliminated) {
+					continue
+				}
+				lowerBound(r, flip(round.tallies[order[j]]-below), [2]int{order[j-1], order[j]})
+				if !rules.batchElimination {
+					break
+				}
+			}
+		}
+
+		others := make([]int, 0, n-1)
+		for _, id := range order {
+			if id != winner {
+				others = append(others, id)
+			}
+		}
+		if _, ok := round.tallies[winner]; !ok || len(others) == 0 {
+			continue
+		}
+		w, weakest := round.tallies[winner], others[0]
+		need := (w-round.tallies[weakest])/2 + 1
+		if len(others) > 1 {
+			need = max(need, w-round.tallies[others[1]]+1)
+		}
+		if need <= w {
+			changes = append(changes, change{r, need, weakest})
+		}
+	}
+
+	slices.SortStableFunc(changes, func(c1, c2 change) bool { return c1.need < c2.need })
+	for _, c := range changes {
+		changed := swapVotes(ballots, rounds[c.round], winner, c.weakest, c.need)
+		after := runIRV(changed, candidates, rules)
+		if len(after) > 0 && after[len(after)-1].winner != winner {
+			ret.upper, ret.upperRound, ret.upperPair = c.need, c.round, [2]int{winner, c.weakest}
+			break
+		}
+	}
+	return ret
+}
+
+// swapVotes returns the ballots with n of those counting for from in the
+// given round changed to rank to in its place (and from in to's, if it was
+// ranked).
+func swapVotes(ballots []rcvBallot, round irvRoundResults, from, to, n int) []rcvBallot {
+	out := slices.Clone(ballots)
+	for i, ballot := range out {
+		if n == 0 {
+			break
+		}
+		at := slices.IndexFunc(ballot.ranks, func(id int) bool {
+			_, ok := round.tallies[id]
+			return ok
+		})
+		if at < 0 || ballot.ranks[at] != from {
+			continue
+		}
+		ranks := slices.Clone(ballot.ranks)
+		if j := slices.Index(ranks, to); j >= 0 {
+			ranks[j] = from
+		}
+		ranks[at] = to
+		out[i].ranks = ranks
+		n--
+	}
+	return out
+}
+
+func formatIRVMargin(m irvMargin, candidates map[int]string) string {
+	if m.lower < 0 {
+		return "Margin of victory: none, the winner was unopposed\n"
+	}
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "Margin of victory: at least %v ballots (round %v, %v vs. %v)\n",
+		m.lower, m.lowerRound+1, candidates[m.lowerPair[0]], candidates[m.lowerPair[1]])
+	if m.upper >= 0 {
+		fmt.Fprintf(&buf, "At most %v ballots: changing them from %v to %v as of round %v changes the winner\n",
+			m.upper, candidates[m.upperPair[0]], candidates[m.upperPair[1]], m.upperRound+1)
+	}
+	return buf.String()
+}
+
+// IRVResult is an IRV tabulation.
+type IRVResult struct {
+	Rounds []IRVRound     `json:"rounds"`
+	Winner *CandidateInfo `json:"winner"` // nil if no ballot counted for anyone
+	// bounds on the margin of victory, in ballots, or -1 if there's none;
+	// MarginUpper is a change we found, and checked, that changes the winner
+	MarginLower int `json:"marginLower"`
+	MarginUpper int `json:"marginUpper"`
+}
+
+type IRVRound struct {
+	// votes for each continuing candidate
+	Tallies    []CandidateCount `json:"tallies"`
+	Exhausted  int              `json:"exhausted"`
+	Overvotes  int              `json:"overvotes"`
+	Continuing int              `json:"continuing"`
+	Threshold  int              `json:"threshold"` // votes needed to win
+	Eliminated []CandidateInfo  `json:"eliminated,omitempty"`
+	// votes that move from each eliminated candidate in the next round
+	Transfers []IRVTransfer  `json:"transfers,omitempty"`
+	Winner    *CandidateInfo `json:"winner,omitempty"`
+}
+
+type IRVTransfer struct {
+	From  CandidateInfo `json:"from"`
+	To    CandidateInfo `json:"to"`
+	Votes int           `json:"votes"`
+}
+
+func irvResult(rounds []irvRoundResults, margin irvMargin, names candidateNames) IRVResult {
+	byName := func(ids []int) []int {
+		slices.SortFunc(ids, func(i, j int) bool {
+			return less(irvName(i, names.short), irvName(j, names.short))
+		})
+		return ids
+	}
+
+	ret := IRVResult{
+		Rounds:      []IRVRound{},
+		MarginLower: margin.lower,
+		MarginUpper: margin.upper,
+	}
+	for _, round := range rounds {
+		continuing := round.continuing()
+		r := IRVRound{
+			Exhausted:  round.exhausted,
+			Overvotes:  round.overvotes,
+			Continuing: continuing,
+			Threshold:  continuing/2 + 1,
+			Eliminated: names.sorted(round.eliminated),
+		}
+		for _, id := range byName(maps.Keys(round.tallies)) {
+			r.Tallies = append(r.Tallies, CandidateCount{names.info(id), round.tallies[id]})
+		}
+		for _, from := range byName(maps.Keys(round.transfers)) {
+			for _, to := range byName(maps.Keys(round.transfers[from])) {
+				r.Transfers = append(r.Transfers,
+					IRVTransfer{names.info(from), names.info(to), round.transfers[from][to]})
+			}
+		}
+		if round.winner != 0 {
+			winner := names.info(round.winner)
+			r.Winner, ret.Winner = &winner, &winner
+		}
+		ret.Rounds = append(ret.Rounds, r)
+	}
+	return ret
+}
@@ -3,12 +3,16 @@ package main
 import (
 	"archive/zip"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"strings"
 
+	"golang.org/x/exp/slices"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -164,7 +168,10 @@ type file struct {
 
 type loader interface {
 	load(name string) (fs.File, error)
-	files() ([]fs.FileInfo, error)
+	// files returns the paths of the files in the export, to load, in order.
+	files() ([]string, error)
+	// openZip opens a ZIP file in the export.
+	openZip(name string) (loader, error)
 	Close() error
 }
 
@@ -184,53 +191,180 @@ func (dl *dirLoader) load(name string) (fs.File, error) {
 	return os.Open(filepath.Join(dl.dir, name))
 }
 
-func (dl *dirLoader) files() ([]fs.FileInfo, error) {
-	f, err := os.Open(dl.dir)
+func (dl *dirLoader) files() ([]string, error) {
+	entries, err := os.ReadDir(dl.dir)
 	if err != nil {
 		return nil, err
 	}
-	return f.Readdir(0)
+	var ret []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			ret = append(ret, entry.Name())
+		}
+	}
+	return ret, nil
+}
+
+func (dl *dirLoader) openZip(name string) (loader, error) {
+	return newZipLoader(filepath.Join(dl.dir, name))
 }
 
 func (dl *dirLoader) Close() error { return nil }
 
 type zipLoader struct {
 	*zip.ReadCloser
+	tmp string // if set, the ZIP was extracted from another, to here
 }
 
 func newZipLoader(path string) (*zipLoader, error) {
 	r, err := zip.OpenReader(path)
-	return &zipLoader{r}, err
+	return &zipLoader{ReadCloser: r}, err
+}
+
+// openZip extracts a nested ZIP file to a temporary file, as reading a ZIP
+// needs random access, which compressed entries don't allow.
+func (zl *zipLoader) openZip(name string) (loader, error) {
+	i := slices.IndexFunc(zl.File, func(f *zip.File) bool { return f.Name == name })
+	if i == -1 {
+		return nil, fmt.Errorf("%v: %w", name, fs.ErrNotExist)
+	}
+	f, err := zl.File[i].Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tmp, err := os.CreateTemp("", "sfballots-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(tmp, f)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	var r *zip.ReadCloser
+	if err == nil {
+		r, err = zip.OpenReader(tmp.Name())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	return &zipLoader{r, tmp.Name()}, nil
+}
+
+func (zl *zipLoader) Close() error {
+	err := zl.ReadCloser.Close()
+	if zl.tmp != "" {
+		if removeErr := os.Remove(zl.tmp); err == nil {
+			err = removeErr
+		}
+	}
+	return err
 }
 
 func (zl *zipLoader) load(name string) (fs.File, error) {
 	return zl.Open(name)
 }
 
-func (zl *zipLoader) files() ([]fs.FileInfo, error) {
-	ret := make([]fs.FileInfo, len(zl.File))
-	for i, f := range zl.File {
-		ret[i] = f.FileInfo()
+func (zl *zipLoader) files() ([]string, error) {
+	var ret []string
+	for _, f := range zl.File {
+		if !strings.HasSuffix(f.Name, "/") {
+			ret = append(ret, f.Name)
+		}
 	}
 	return ret, nil
 }
 
-func LoadAll(dirOrZip string) (*RawBallotData, error) {
+// openLoader opens a CVR export, as a directory or a ZIP file.
+func openLoader(dirOrZip string) (loader, error) {
 	stat, err := os.Stat(dirOrZip)
 	if err != nil {
 		return nil, err
 	}
-
-	var loader loader
 	if stat.IsDir() {
-		loader = &dirLoader{dirOrZip}
-	} else {
-		loader, err = newZipLoader(dirOrZip)
+		return &dirLoader{dirOrZip}, nil
+	}
+	return newZipLoader(dirOrZip)
+}
+
+// An exportPart is a directory or ZIP file with all of an export's
+// manifests, and some or all of its CVRs.
+type exportPart struct {
+	name   string
+	loader loader
+}
+
+func closeParts(parts []exportPart) error {
+	var ret error
+	for _, part := range parts {
+		if err := part.loader.Close(); ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// openParts opens the parts of a CVR export. Usually there's just one, the
+// directory or ZIP file itself, but some counties publish a ZIP of ZIPs, or
+// split the export into ZIP files, one per counting group or per day. So if
+// the export has no manifests of its own, each ZIP file in it (or in a ZIP
+// file in it, and so on) is a part.
+func openParts(dirOrZip string) ([]exportPart, error) {
+	loader, err := openLoader(dirOrZip)
+	if err != nil {
+		return nil, err
+	}
+	var parts []exportPart
+	err = findParts(dirOrZip, loader, &parts)
+	if err == nil && len(parts) == 0 {
+		err = fmt.Errorf("no CVR export in %v", dirOrZip)
+	}
+	if err != nil {
+		closeParts(parts)
+		return nil, err
+	}
+	return parts, nil
+}
+
+// findParts adds the parts in loader to parts, closing loader unless it's a
+// part itself.
+func findParts(name string, loader loader, parts *[]exportPart) error {
+	filenames, err := loader.files()
+	if err != nil {
+		loader.Close()
+		return err
+	}
+	var zips []string
+	for _, filename := range filenames {
+		switch {
+		case filename == "ContestManifest.json":
+			*parts = append(*parts, exportPart{name, loader})
+			return nil
+		case strings.EqualFold(path.Ext(filename), ".zip"):
+			// anywhere in a ZIP, as in a zipped folder of parts
+			zips = append(zips, filename)
+		}
+	}
+	defer loader.Close()
+
+	slices.Sort(zips)
+	for _, zipName := range zips {
+		inner, err := loader.openZip(zipName)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("%v: %w", name, err)
+		}
+		err = findParts(name+"/"+zipName, inner, parts)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
+// loadManifests decodes everything but the CVRs.
+func loadManifests(loader loader) (*RawBallotData, error) {
 	var out RawBallotData
 	rv := reflect.ValueOf(&out).Elem()
 	typ := rv.Type()
@@ -246,27 +380,269 @@ func LoadAll(dirOrZip string) (*RawBallotData, error) {
 			return nil, err
 		}
 	}
+	return &out, nil
+}
+
+// partManifests loads the manifests of each part, and checks that they're
+// the same in every part.
+func partManifests(parts []exportPart) (*RawBallotData, error) {
+	var out *RawBallotData
+	for _, part := range parts {
+		manifests, err := loadManifests(part.loader)
+		if len(parts) > 1 && err != nil {
+			err = fmt.Errorf("%v: %w", part.name, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if out == nil {
+			out = manifests
+			continue
+		}
+		if name := differentManifest(out, manifests); name != "" {
+			return nil, fmt.Errorf("%v and %v have different %v files",
+				parts[0].name, part.name, name)
+		}
+	}
+	return out, nil
+}
 
-	fileInfos, err := loader.files()
+// differentManifest returns the name of the first manifest that differs
+// between a and b, or "" if they're all the same.
+func differentManifest(a, b *RawBallotData) string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	typ := va.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Tag.Get("file")
+		if name == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(manifestEntries(va.Field(i)), manifestEntries(vb.Field(i))) {
+			return name + ".json"
+		}
+	}
+	return ""
+}
+
+// manifestEntries indexes a manifest's entries by ID, or if they have none
+// (as for the pairs in BallotTypeContestManifest), by their value, so that
+// manifests listing the same entries in a different order match.
+func manifestEntries(list reflect.Value) map[any]any {
+	ret := make(map[any]any, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		entry := list.Index(i).Elem()
+		key := entry.Interface()
+		if id := entry.FieldByName("ID"); id.IsValid() {
+			key = id.Interface()
+		}
+		ret[key] = entry.Interface()
+	}
+	return ret
+}
+
+func cvrFilenames(loader loader) ([]string, error) {
+	filenames, err := loader.files()
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, filename := range filenames {
+		if strings.HasPrefix(filename, "CvrExport") {
+			ret = append(ret, filename)
+		}
+	}
+	return ret, nil
+}
+
+// sessionDeduper drops sessions from a part that were already in an earlier
+// one, as when parts overlap. Sessions with the same key within a part are
+// all kept.
+type sessionDeduper struct {
+	seen    map[ballotKey]int // ballot -> the part it was first in
+	dropped int
+}
+
+func newSessionDeduper(parts []exportPart) *sessionDeduper {
+	if len(parts) == 1 {
+		return nil // nothing to remember
+	}
+	return &sessionDeduper{seen: map[ballotKey]int{}}
+}
+
+func (d *sessionDeduper) keep(part int, session *RawSession) bool {
+	if d == nil {
+		return true
+	}
+	key := sessionBallotKey(session)
+	if first, ok := d.seen[key]; ok && first != part {
+		d.dropped++
+		return false
+	}
+	d.seen[key] = part
+	return true
+}
+
+func (d *sessionDeduper) log(dirOrZip string) {
+	if d != nil && d.dropped > 0 {
+		logf("%v: skipped %d sessions already in an earlier part", dirOrZip, d.dropped)
+	}
+}
+
+// loadAll parses a CVR export, merging its parts.
+func loadAll(dirOrZip string) (*RawBallotData, error) {
+	parts, err := openParts(dirOrZip)
+	if err != nil {
+		return nil, err
+	}
+	defer closeParts(parts)
+
+	out, err := partManifests(parts)
 	if err != nil {
 		return nil, err
 	}
-	var cvrFilenames []string
-	for _, fileInfo := range fileInfos {
-		if strings.HasPrefix(fileInfo.Name(), "CvrExport") {
-			cvrFilenames = append(cvrFilenames, fileInfo.Name())
+	var partIndexes []int // of each CVR
+	var loaders []loader
+	var filenames []string
+	for i, part := range parts {
+		names, err := cvrFilenames(part.loader)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			partIndexes = append(partIndexes, i)
+			loaders = append(loaders, part.loader)
+			filenames = append(filenames, name)
 		}
 	}
 
-	out.CVRs = make([]*RawCVR, len(cvrFilenames))
+	out.CVRs = make([]*RawCVR, len(filenames))
 	var g errgroup.Group
 	g.SetLimit(512) // avoid ulimit problems
-	for i, filename := range cvrFilenames {
+	for i, filename := range filenames {
 		i, filename := i, filename
 		g.Go(func() error {
-			err := decode(loader, filename, &out.CVRs[i])
+			err := decode(loaders[i], filename, &out.CVRs[i])
 			return err
 		})
 	}
-	return &out, g.Wait()
+	err = g.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	dedupe := newSessionDeduper(parts)
+	for i, cvr := range out.CVRs {
+		kept := cvr.Sessions[:0]
+		for _, session := range cvr.Sessions {
+			if dedupe.keep(partIndexes[i], session) {
+				kept = append(kept, session)
+			}
+		}
+		cvr.Sessions = kept
+	}
+	dedupe.log(dirOrZip)
+	return out, nil
+}
+
+// An Export is an open CVR export, for reading its sessions one at a time,
+// as many times as needed, without reopening its parts.
+type Export struct {
+	name  string
+	parts []exportPart
+}
+
+func OpenExport(dirOrZip string) (*Export, error) {
+	parts, err := openParts(dirOrZip)
+	if err != nil {
+		return nil, err
+	}
+	return &Export{dirOrZip, parts}, nil
+}
+
+func (e *Export) Close() error {
+	return closeParts(e.parts)
+}
+
+// LoadManifests loads everything in the export but the CVRs themselves,
+// which StreamSessions reads.
+func (e *Export) LoadManifests() (*RawBallotData, error) {
+	return partManifests(e.parts)
+}
+
+// StreamSessions calls visit with each session in the export, in the order
+// loadAll would return them. It decodes one session at a time, so unlike
+// LoadAll it needs memory only for the current session (and, for an export
+// in parts, the keys of the ballots it's seen). It stops at the first error
+// from visit, and returns it.
+func (e *Export) StreamSessions(visit func(*RawSession) error) error {
+	dedupe := newSessionDeduper(e.parts)
+	for i, part := range e.parts {
+		filenames, err := cvrFilenames(part.loader)
+		if err != nil {
+			return err
+		}
+		for _, filename := range filenames {
+			err := streamFile(part.loader, filename, func(session *RawSession) error {
+				if !dedupe.keep(i, session) {
+					return nil
+				}
+				return visit(session)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	dedupe.log(e.name)
+	return nil
+}
+
+// streamFile decodes the sessions in a CvrExport file one at a time.
+func streamFile(loader loader, filename string, visit func(*RawSession) error) error {
+	f, err := loader.load(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	expect := func(want json.Delim) error {
+		tok, err := dec.Token()
+		if err == nil && tok != want {
+			err = fmt.Errorf("expected %v, got %v", want, tok)
+		}
+		return err
+	}
+
+	err = expect('{')
+	for err == nil && dec.More() {
+		var key json.Token
+		key, err = dec.Token()
+		if err != nil {
+			break
+		}
+		if key != "Sessions" {
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+			continue
+		}
+		err = expect('[')
+		for err == nil && dec.More() {
+			var session RawSession
+			err = dec.Decode(&session)
+			if err == nil {
+				err = visit(&session)
+			}
+		}
+		if err == nil {
+			err = expect(']')
+		}
+	}
+	if err == nil {
+		err = expect('}')
+	}
+	if _, ok := err.(*json.SyntaxError); ok {
+		err = fmt.Errorf("%v: %w", filename, err)
+	}
+	return err
 }
@@ -1,101 +1,752 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
-func doMany(b *BallotData, prefix string, show bool, ids ...int) {
-	results := AnalyzeManyContests(b, len(ids) > 2, ids...)
-	if show {
-		fmt.Print(formatResults(results))
+// Output settings, from the command-line flags.
+var (
+	// file formats to write, from the command's list (gridFormats etc.)
+	formats []string
+	// don't report files written
+	quiet bool
+	// report progress on stderr
+	verbose bool
+	// print results as JSON, rather than text
+	jsonOutput bool
+	// results to print as JSON
+	shown []Result
+)
+
+func wantFormat(format string) bool {
+	return slices.Contains(formats, format)
+}
+
+func logf(format string, args ...any) {
+	if verbose {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
+
+// show prints a result as text, or saves it to print as JSON.
+func show(r Result) {
+	if jsonOutput {
+		shown = append(shown, r)
+		return
+	}
+	if cg := r.header().CountingGroup; cg != nil {
+		fmt.Printf("Counting group: %v\n", cg.Description)
 	}
-	filename := prefix + "results_" + strings.Join(map1(strconv.Itoa, ids), "_") + ".csv"
-	err := os.WriteFile(filename, []byte(formatCSV(results)), 0o644)
+	fmt.Print(r.Text())
+}
+
+// flush prints the results shown, if printing JSON.
+func flush() {
+	if !jsonOutput {
+		return
+	}
+	out, err := json.MarshalIndent(shown, "", "  ")
 	if err != nil {
 		panic(err)
 	}
-	fmt.Println("wrote", filename)
+	fmt.Println(string(out))
 }
 
-func main() {
-	if len(os.Args) == 1 {
-		fmt.Printf("usage: %s data/CVR_Export_YYYYMMDDHHMMSS.zip> [<contest IDs>]\n", os.Args[0])
-		os.Exit(1)
+func doMany(b *BallotData, prefix string, display, coalesceInvalid bool, ids ...int) {
+	results := AnalyzeManyContests(b, coalesceInvalid, ids...)
+	if display {
+		show(results)
+	}
+	if wantFormat("csv") {
+		filename := prefix + "results_" + strings.Join(map1(strconv.Itoa, ids), "_") + ".csv"
+		writeFile(filename, formatCSV(results.results))
 	}
+}
 
-	d, err := LoadAll(os.Args[1])
+func writeFile(filename, contents string) {
+	err := os.WriteFile(filename, []byte(contents), 0o644)
 	if err != nil {
 		panic(err)
 	}
+	switch {
+	case quiet:
+	case jsonOutput:
+		fmt.Fprintln(os.Stderr, "wrote", filename)
+	default:
+		fmt.Println("wrote", filename)
+	}
+}
 
-	prefix, _, _ := strings.Cut(os.Args[1], ".")
-	prefix += "_"
+// fileSafe replaces anything but letters and digits with "_", for use in a
+// filename.
+func fileSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, s)
+}
 
-	b, err := BuildBallotData(d)
+// writePrecinctMap writes the results of a contest joined to the precinct
+// boundaries in a GeoJSON file, as GeoJSON and as an HTML map.
+func writePrecinctMap(b *BallotData, id int, rules rcvBallotRules, prefix, filename, key string) {
+	// reload each time, since we attach results to the features
+	fc, err := loadGeoJSON(filename)
+	if err != nil {
+		panic(err)
+	}
+	m, err := JoinPrecinctMap(b, id, rules, fc, key)
 	if err != nil {
 		panic(err)
 	}
+	fmt.Fprint(os.Stderr, m.formatUnmatched())
+	if wantFormat("geojson") {
+		geo, err := json.Marshal(m.features)
+		if err != nil {
+			panic(err)
+		}
+		writeFile(prefix+"map_"+strconv.Itoa(id)+".geojson", string(geo))
+	}
+	if wantFormat("html") {
+		page, err := m.formatChoroplethHTML()
+		if err != nil {
+			panic(err)
+		}
+		writeFile(prefix+"map_"+strconv.Itoa(id)+".html", page)
+	}
+}
+
+// analyzeContest analyzes a contest, according to its type.
+func analyzeContest(b *BallotData, id int, opts rcvOptions) Result {
+	if b.Contests[id].NumOfRanks > 0 {
+		return AnalyzeRCVContest(b, id, opts)
+	} else if b.Contests[id].VoteFor > 1 {
+		return AnalyzeVoteForNContest(b, id)
+	} else {
+		return AnalyzeContest(b, id)
+	}
+}
+
+// writeContestFiles writes the grids for a contest, according to its type.
+func writeContestFiles(b *BallotData, r Result, prefix string) {
+	switch r := r.(type) {
+	case *RCVResult:
+		r.writeFiles(prefix)
+	case *VoteForNResult:
+		id := r.Contest.ID
+		counts, shares := CoVoteGrids(b, id)
+		writeGrid(prefix, "covotes_"+strconv.Itoa(id), counts)
+		writeGrid(prefix, "covote_shares_"+strconv.Itoa(id), shares)
+	}
+}
 
-	ids := make([]int, len(os.Args)-2)
-	for i, arg := range os.Args[2:] {
-		ids[i], err = strconv.Atoi(arg)
+func writeGrid(prefix, basename string, grid [][]any) {
+	if wantFormat("csv") {
+		writeFile(prefix+basename+".csv", formatGrid(grid))
+	}
+	if wantFormat("html") {
+		writeFile(prefix+basename+".html", formatGridHTML(grid))
+	}
+}
+
+func parseIDs(args []string) []int {
+	ids := make([]int, len(args))
+	for i, arg := range args {
+		var err error
+		ids[i], err = strconv.Atoi(strings.TrimSpace(arg))
 		if err != nil {
 			panic(err)
 		}
 	}
+	return ids
+}
 
-	if len(ids) == 0 {
-		fmt.Println(b)
+// fail reports a problem with the command line, and exits.
+func fail(err any) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(2)
+}
+
+// commonFlags are the flags every command takes.
+type commonFlags struct {
+	fs       *flag.FlagSet
+	out      *string
+	formats  *string
+	format   *string
+	quiet    *bool
+	verbose  *bool
+	district *string
+	stream   *bool
+	cache    *string
+
+	// the file formats the command can write
+	allowedFormats []string
+}
+
+func newFlagSet(name, args, help, defaultFormats string) *commonFlags {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s [flags] %s\n%s\n", os.Args[0], name, args, help)
+		fs.PrintDefaults()
+	}
+	return &commonFlags{
+		fs: fs,
+		out: fs.String("out", "",
+			"directory for output files (default: next to the input)"),
+		formats: fs.String("formats", defaultFormats,
+			"comma-separated output file formats ("+strings.ReplaceAll(defaultFormats, ",", ", ")+"), or none"),
+		format: fs.String("format", "text",
+			"how to print results: text, or json"),
+		quiet: fs.Bool("quiet", false,
+			"don't report files written"),
+		verbose: fs.Bool("verbose", false,
+			"report progress on stderr"),
+		district: fs.String("district", "",
+			"also select every contest in this district (ID, name, or pattern)"),
+		stream: fs.Bool("stream", false,
+			"read ballots from the export as each analysis needs them, to use less memory"),
+		cache: fs.String("cache", ternary(cacheDir == "", "none", cacheDir),
+			"directory to cache parsed exports in, each as a full copy of its ballots, or none"),
+		allowedFormats: strings.Split(defaultFormats, ","),
+	}
+}
+
+// parse parses the command line, and sets the output settings.
+func (c *commonFlags) parse(args []string) {
+	c.fs.Parse(args)
+	if c.fs.NArg() == 0 {
+		c.fs.Usage()
+		os.Exit(2)
+	}
+	for _, arg := range c.fs.Args() {
+		if len(arg) > 1 && arg[0] == '-' {
+			fail(fmt.Sprintf("flag %v after the export: flags must come first", arg))
+		}
+	}
+	formats = nil
+	if *c.formats != "none" {
+		formats = nonempty(strings.Split(*c.formats, ","))
+	}
+	for _, format := range formats {
+		if !slices.Contains(c.allowedFormats, format) {
+			fail(fmt.Sprintf("bad -formats %q: want some of %v, or none",
+				*c.formats, strings.Join(c.allowedFormats, ", ")))
+		}
+	}
+	quiet = *c.quiet
+	verbose = *c.verbose
+	cacheDir = ternary(*c.cache == "none", "", *c.cache)
+	switch *c.format {
+	case "text":
+		jsonOutput = false
+	case "json":
+		jsonOutput = true
+		shown = []Result{}
+	default:
+		fail(fmt.Sprintf("bad -format %q: want text or json", *c.format))
+	}
+}
+
+// filesOnly rejects -format json, for commands that only write files.
+func (c *commonFlags) filesOnly() {
+	if jsonOutput {
+		fail(fmt.Sprintf("%v: no -format json: it only writes files; see -formats", c.fs.Name()))
+	}
+}
+
+// prefix returns the start of the names of output files: the input filename
+// up to the first ".", in the output directory.
+func (c *commonFlags) prefix() string {
+	input := c.fs.Arg(0)
+	name, _, _ := strings.Cut(filepath.Base(input), ".")
+	dir := filepath.Dir(input)
+	if *c.out != "" {
+		dir = *c.out
+		err := os.MkdirAll(dir, 0o755)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return filepath.Join(dir, name) + "_"
+}
+
+// load loads the export, and selects the contests given on the command line.
+func (c *commonFlags) load() (*BallotData, []int) {
+	start := time.Now()
+	logf("loading %v", c.fs.Arg(0))
+	var b *BallotData
+	var err error
+	if *c.stream {
+		b, err = StreamBallotData(c.fs.Arg(0))
+	} else {
+		var d *RawBallotData
+		d, err = LoadAll(c.fs.Arg(0))
+		if err == nil {
+			b, err = BuildBallotData(d)
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+	logf("loaded %v in %v", b, time.Since(start).Round(time.Millisecond))
+
+	ids, err := SelectContests(b, c.fs.Args()[1:])
+	if err == nil && *c.district != "" {
+		var districtIDs []int
+		districtIDs, err = DistrictContests(b, *c.district)
+		for _, id := range districtIDs {
+			if !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if err != nil {
+		b.Close()
+		fail(err)
+	}
+	return b, ids
+}
+
+// loadContests is load, for commands that need at least n contests.
+func (c *commonFlags) loadContests(n int) (*BallotData, []int) {
+	b, ids := c.load()
+	if len(ids) < n {
+		b.Close()
+		fail(fmt.Sprintf("%v: need at least %v contests", c.fs.Name(), n))
+	}
+	return b, ids
+}
+
+// loadPluralityContests is loadContests, for commands that only handle
+// vote-for-one contests.
+func (c *commonFlags) loadPluralityContests(n int) (*BallotData, []int) {
+	b, ids := c.loadContests(n)
+	for _, id := range ids {
+		if contest := b.Contests[id]; contest.NumOfRanks > 0 || contest.VoteFor > 1 {
+			b.Close()
+			fail(fmt.Sprintf("%v: %v is not a vote-for-one contest", c.fs.Name(), contest.Description))
+		}
+	}
+	return b, ids
+}
 
+// addBallotRulesFlags adds the flags for how to interpret ranked ballots: a
+// preset, and a flag for each of its rules to override it.
+func addBallotRulesFlags(fs *flag.FlagSet) func() rcvBallotRules {
+	rcvRules := fs.String("rcv-rules", "sf",
+		"how to interpret ranked ballots: sf, alaska, maine, or nyc")
+	maxSkipped := fs.Int("max-skipped-ranks", -1,
+		"exhaust a ranked ballot after this many consecutive skipped ranks, 0 to ignore them, or -1 for the -rcv-rules default")
+	overvote := fs.String("overvote", "",
+		"on a rank with two candidates: exhaust the ballot, or skip the rank (default from -rcv-rules)")
+	duplicate := fs.String("duplicate", "",
+		"on a repeated candidate: skip the rank, or exhaust the ballot (default from -rcv-rules)")
+	countAmbiguous := fs.Bool("count-ambiguous", false,
+		"count marks the scanner flagged as ambiguous")
+	return func() rcvBallotRules {
+		rules, ok := rcvBallotRulesPresets[*rcvRules]
+		if !ok {
+			fail(fmt.Sprintf("unknown RCV rules %q", *rcvRules))
+		}
+		if *maxSkipped >= 0 {
+			rules.maxSkippedRanks = *maxSkipped
+		}
+		switch *overvote {
+		case "":
+		case "exhaust":
+			rules.overvote = overvoteExhaust
+		case "skip":
+			rules.overvote = overvoteSkip
+		default:
+			fail(fmt.Sprintf("unknown -overvote policy %q", *overvote))
+		}
+		switch *duplicate {
+		case "":
+		case "skip":
+			rules.duplicate = duplicateSkip
+		case "exhaust":
+			rules.duplicate = duplicateExhaust
+		default:
+			fail(fmt.Sprintf("unknown -duplicate policy %q", *duplicate))
+		}
+		if *countAmbiguous {
+			rules.countAmbiguous = true
+		}
+		return rules
+	}
+}
+
+// addRCVFlags adds the flags for how to tabulate ranked contests, and
+// returns a function to get the resulting options once they're parsed.
+func addRCVFlags(fs *flag.FlagSet) func() rcvOptions {
+	ballotRules := addBallotRulesFlags(fs)
+	drawOrder := fs.String("draw", "",
+		"comma-separated candidate IDs, in the order drawn to lose IRV ties")
+	tieBreak := fs.String("tiebreak", sfIRVRules.tieBreak.String(),
+		"how to break IRV ties: draw, or prior (by prior rounds, then draw)")
+	noBatch := fs.Bool("no-batch", false,
+		"eliminate one IRV candidate per round, instead of all that can't win")
+	untilTwo := fs.Bool("until-two", false,
+		"continue IRV until two candidates remain, even once one has a majority")
+	spoilers := fs.Bool("spoilers", false,
+		"rerun ranked contests with each candidate withdrawn in turn")
+	withdrawn := fs.String("withdraw", "",
+		"comma-separated candidate IDs to withdraw together from each ranked contest they're all candidates in")
+	stvSeats := fs.Int("stv-seats", 0,
+		"also tabulate ranked contests by STV for this many seats")
+	stvQuotaName := fs.String("stv-quota", quotaDroop.String(),
+		"STV quota: droop or hare")
+	stvTransferName := fs.String("stv-transfer", transferWIGM.String(),
+		"STV surplus transfer: wigm (weighted inclusive Gregory) or meek")
+
+	return func() rcvOptions {
+		opts := rcvOptions{
+			ballot:   ballotRules(),
+			irv:      sfIRVRules,
+			stv:      stvOptions{seats: *stvSeats},
+			spoilers: *spoilers,
+		}
+		var err error
+		opts.irv.tieBreak, err = parseTieBreak(*tieBreak)
+		if err != nil {
+			fail(err)
+		}
+		if *drawOrder != "" {
+			opts.irv.drawOrder = parseIDs(strings.Split(*drawOrder, ","))
+		}
+		opts.irv.batchElimination = !*noBatch
+		opts.irv.untilTwo = *untilTwo
+		if *withdrawn != "" {
+			opts.withdraw = parseIDs(strings.Split(*withdrawn, ","))
+		}
+		opts.stv.quota, opts.stv.transfer, err = parseSTVOptions(*stvQuotaName, *stvTransferName)
+		if err != nil {
+			fail(err)
+		}
+		return opts
+	}
+}
+
+// rankedCandidates returns the candidates in each of the given contests that
+// are ranked, by contest description.
+func rankedCandidates(b *BallotData, ids []int) map[string]map[int]string {
+	ret := map[string]map[int]string{}
+	for _, id := range ids {
+		if b.Contests[id].NumOfRanks > 0 {
+			ret[b.Contests[id].Description] = fullNames(b, id)
+		}
+	}
+	return ret
+}
+
+// checkWithdraw checks the -withdraw candidates against the selected ranked
+// contests (by description): they must all be candidates in at least one,
+// and not every candidate in any. Contests they aren't all candidates in
+// skip the scenario, so one run can cover a contest and others besides.
+func checkWithdraw(withdraw []int, contests map[string]map[int]string) error {
+	if len(withdraw) == 0 {
+		return nil
+	}
+	descriptions := maps.Keys(contests)
+	slices.Sort(descriptions)
+	found := false
+	for _, description := range descriptions {
+		ok, err := canWithdraw(withdraw, contests[description])
+		if err != nil {
+			return fmt.Errorf("-withdraw: %v: %w", description, err)
+		}
+		found = found || ok
+	}
+	if !found {
+		return fmt.Errorf("-withdraw %v: not all candidates in any selected ranked contest",
+			strings.Join(map1(strconv.Itoa, withdraw), ","))
+	}
+	return nil
+}
+
+// coalesce interprets the -coalesce flag.
+func coalesce(value string, ids []int) bool {
+	switch value {
+	case "auto":
+		return len(ids) > 2
+	case "true":
+		return true
+	case "false":
+		return false
+	default:
+		fail(fmt.Sprintf("bad -coalesce %q: want auto, true, or false", value))
+		return false
+	}
+}
+
+const (
+	exportArgs      = "data/CVR_Export_YYYYMMDDHHMMSS.zip"
+	contestArgs     = exportArgs + " <contests>"
+	contestHelp     = "Contests may be given by ID, or by name, substring, or regex, ignoring case."
+	gridFormats     = "csv,html"
+	rcvFormats      = "csv,html,json"
+	precinctFormats = "csv,html,geojson"
+	rankedFormats   = "blt,soi,toi"
+)
+
+func runList(args []string) {
+	c := newFlagSet("list", exportArgs,
+		"List the contests in an export, and which appear together on cards.", gridFormats)
+	c.parse(args)
+	b, _ := c.load()
+	defer b.Close()
+
+	if !jsonOutput {
+		fmt.Println(b)
 		contestIDs := maps.Keys(b.Contests)
 		sort.Ints(contestIDs)
 		for _, id := range contestIDs {
 			fmt.Println(id, b.Contests[id].Description)
 		}
+	}
+	show(ContestsByCard(b))
+	flush()
+}
+
+func runContest(args []string) {
+	c := newFlagSet("contest", contestArgs,
+		"Show the results of each contest, according to its type.\n"+contestHelp, rcvFormats)
+	rcvOpts := addRCVFlags(c.fs)
+	byCountingGroup := c.fs.Bool("by-counting-group", false,
+		"also show results separately for each counting group (vote-by-mail, election day, etc.)")
+	c.parse(args)
+	opts := rcvOpts()
+	b, ids := c.loadContests(1)
+	defer b.Close()
+	if err := checkWithdraw(opts.withdraw, rankedCandidates(b, ids)); err != nil {
+		b.Close()
+		fail(err)
+	}
+	prefix := c.prefix()
+
+	var groups map[int]*BallotData
+	if *byCountingGroup {
+		groups = ByCountingGroup(b)
+	}
+
+	for _, id := range ids {
+		r := analyzeContest(b, id, opts)
+		show(r)
+		writeContestFiles(b, r, prefix)
+		if *byCountingGroup {
+			for _, group := range countingGroups(b) {
+				r := analyzeContest(groups[group], id, opts)
+				r.header().CountingGroup = countingGroupInfo(b, group)
+				show(r)
+			}
+			show(CountingGroupShifts(b, id, opts.ballot))
+		}
+	}
+	flush()
+}
 
-		ShowContestsByCard(b)
+func runRCV(args []string) {
+	c := newFlagSet("rcv", contestArgs+"\n       "+os.Args[0]+" rcv [flags] ballots.{blt,soi,toi}",
+		"Tabulate ranked contests, or ranked ballots in BLT or PrefLib format.\n"+contestHelp, rcvFormats)
+	rcvOpts := addRCVFlags(c.fs)
+	c.parse(args)
+	opts := rcvOpts()
+	prefix := c.prefix()
 
+	if isRankedBallotFile(c.fs.Arg(0)) {
+		f := ReadRankedBallotFile(c.fs.Arg(0))
+		err := checkWithdraw(opts.withdraw, map[string]map[int]string{
+			f.contest.description: f.contest.candidates,
+		})
+		if err != nil {
+			fail(err)
+		}
+		r := AnalyzeRankedBallotFile(f, opts)
+		show(r)
+		r.writeFiles(prefix)
+		flush()
 		return
 	}
 
+	b, ids := c.loadContests(1)
+	defer b.Close()
 	for _, id := range ids {
-		if b.Contests[id].NumOfRanks > 0 {
-			ShowRCVContest(b, id)
-		} else if b.Contests[id].VoteFor > 1 {
-			panic("TODO implement vote for N")
-		} else {
-			ShowContest(b, id)
+		if b.Contests[id].NumOfRanks == 0 {
+			b.Close()
+			fail(fmt.Sprintf("%v is not a ranked contest", b.Contests[id].Description))
 		}
 	}
+	if err := checkWithdraw(opts.withdraw, rankedCandidates(b, ids)); err != nil {
+		b.Close()
+		fail(err)
+	}
+	for _, id := range ids {
+		r := AnalyzeRCVContest(b, id, opts)
+		show(r)
+		r.writeFiles(prefix)
+	}
+	flush()
+}
 
-	for _, is := range powerset(ids) {
-		if len(is) > 1 {
-			doMany(b, prefix, len(is) == len(ids), is...)
+func runCrosstab(args []string) {
+	c := newFlagSet("crosstab", contestArgs,
+		"Show how voters voted across several contests.\n"+contestHelp, gridFormats)
+	coalesceFlag := c.fs.String("coalesce", "auto",
+		"count ballots that abstain or vote invalidly in any contest together: true, false, or auto (for 3 or more contests)")
+	all := c.fs.Bool("powerset", false,
+		"also write crosstabs for every subset of the contests")
+	byCountingGroup := c.fs.Bool("by-counting-group", false,
+		"also show results separately for each counting group (vote-by-mail, election day, etc.)")
+	c.parse(args)
+	b, ids := c.loadPluralityContests(2)
+	defer b.Close()
+	prefix := c.prefix()
+
+	if *all {
+		for _, is := range powerset(ids) {
+			if len(is) > 1 {
+				doMany(b, prefix, len(is) == len(ids), coalesce(*coalesceFlag, is), is...)
+			}
+		}
+	} else {
+		doMany(b, prefix, true, coalesce(*coalesceFlag, ids), ids...)
+	}
+	if *byCountingGroup {
+		groups := ByCountingGroup(b)
+		for _, group := range countingGroups(b) {
+			r := AnalyzeManyContests(groups[group], coalesce(*coalesceFlag, ids), ids...)
+			r.header().CountingGroup = countingGroupInfo(b, group)
+			show(r)
 		}
 	}
+	flush()
+}
+
+func runGrid(args []string) {
+	c := newFlagSet("grid", contestArgs,
+		"Write a grid of how voters voted in each pair of contests.\n"+contestHelp, gridFormats)
+	coalesceFlag := c.fs.String("coalesce", "auto",
+		"leave out ballots that abstain or vote invalidly: true, false, or auto (for 3 or more contests)")
+	c.parse(args)
+	b, ids := c.loadPluralityContests(2)
+	defer b.Close()
 
-	if len(ids) > 1 {
-		grid := GridChart(b, len(ids) > 2, ids...)
-		basename := "results_grid_" + strings.Join(map1(strconv.Itoa, ids), "_")
+	r := GridChart(b, coalesce(*coalesceFlag, ids), ids...)
+	show(r)
+	writeGrid(c.prefix(), "results_grid_"+strings.Join(map1(strconv.Itoa, ids), "_"), r.grid)
+	flush()
+}
 
-		csv := prefix + basename + ".csv"
-		err = os.WriteFile(csv, []byte(formatGrid(grid)), 0o644)
+func runPrecincts(args []string) {
+	c := newFlagSet("precincts", contestArgs,
+		"Write each contest's results by precinct and precinct portion.\n"+contestHelp, precinctFormats)
+	ballotRules := addBallotRulesFlags(c.fs)
+	districtType := c.fs.String("district-type", "",
+		"also write results by district of this type (ID or description)")
+	geoJSON := c.fs.String("geojson", "",
+		"also map results by precinct, using this GeoJSON file of precinct boundaries")
+	geoKeyName := c.fs.String("geojson-key", "",
+		"GeoJSON property with the precinct ID (default: guess)")
+	c.parse(args)
+	c.filesOnly()
+	rules := ballotRules()
+	b, ids := c.loadContests(1)
+	defer b.Close()
+	prefix := c.prefix()
+
+	var districtTypeID string
+	if *districtType != "" {
+		dt, err := b.DistrictType(*districtType)
 		if err != nil {
-			panic(err)
+			fail(err)
 		}
-		fmt.Println("wrote", csv)
+		districtTypeID = dt.ID
+	}
 
-		html := prefix + basename + ".html"
-		err = os.WriteFile(html, []byte(formatGridHTML(grid)), 0o644)
-		if err != nil {
-			panic(err)
+	for _, id := range ids {
+		writeGrid(prefix, "precincts_"+strconv.Itoa(id), PrecinctResults(b, id, rules))
+		writeGrid(prefix, "precinct_portions_"+strconv.Itoa(id), PrecinctPortionResults(b, id, rules))
+		if districtTypeID != "" {
+			writeGrid(prefix, "districts_"+strconv.Itoa(id)+"_"+fileSafe(districtTypeID),
+				DistrictResults(b, id, rules, districtTypeID))
+		}
+		if *geoJSON != "" {
+			writePrecinctMap(b, id, rules, prefix, *geoJSON, *geoKeyName)
+		}
+	}
+}
+
+func runExport(args []string) {
+	c := newFlagSet("export", contestArgs,
+		"Write the ballots in ranked contests in BLT and PrefLib formats.\n"+contestHelp, rankedFormats)
+	ballotRules := addBallotRulesFlags(c.fs)
+	seats := c.fs.Int("seats", 1, "number of seats, for BLT")
+	c.parse(args)
+	c.filesOnly()
+	rules := ballotRules()
+	b, ids := c.loadContests(1)
+	defer b.Close()
+	prefix := c.prefix()
+
+	for _, id := range ids {
+		if b.Contests[id].NumOfRanks == 0 {
+			fail(fmt.Sprintf("%v is not a ranked contest", b.Contests[id].Description))
+		}
+	}
+	for _, id := range ids {
+		contest, ballots, _ := rcvContestBallots(b, id, rules)
+		writeRankedBallotFiles(prefix, contest, ballots, *seats, formats)
+	}
+}
+
+var commands = []struct {
+	name, help string
+	run        func(args []string)
+}{
+	{"list", "list contests", runList},
+	{"contest", "show contest results", runContest},
+	{"rcv", "tabulate ranked contests", runRCV},
+	{"crosstab", "show votes across contests", runCrosstab},
+	{"grid", "write a grid of votes across pairs of contests", runGrid},
+	{"precincts", "write results by precinct or district", runPrecincts},
+	{"export", "write ranked ballots in BLT and PrefLib formats", runExport},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags] %s [<contests>]\n\ncommands:\n", os.Args[0], exportArgs)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10v %v\n", cmd.name, cmd.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the command's flags.\n", os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			cmd.run(os.Args[2:])
+			return
 		}
-		fmt.Println("wrote", html)
 	}
+	if os.Args[1] != "-h" && os.Args[1] != "-help" && os.Args[1] != "help" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+	}
+	usage()
+	os.Exit(2)
 }
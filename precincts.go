@@ -0,0 +1,218 @@
+package main
+
+import (
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// contestTally is the result of a contest among some group of ballots, in the
+// style of a statement of votes: votes for each candidate, plus undervotes
+// and overvotes. A vote-for-N ballot has N votes; an RCV ballot counts for its
+// first choice.
+type contestTally struct {
+	ballots    int // ballots including the contest
+	votes      map[int]int
+	undervotes int
+	overvotes  int
+}
+
+// contestVotes returns a function that scores one ballot's marks in the given
+// contest, as the candidates voted for, and the number of undervotes and
+// overvotes.
+func contestVotes(b *BallotData, contestID int, rules rcvBallotRules) func(*RawCardContest) ([]int, int, int) {
+	contestInfo := b.Contests[contestID]
+	cands, err := candidates(b, contestID)
+	if err != nil {
+		panic(err)
+	}
+
+	switch {
+	case contestInfo.NumOfRanks > 0:
+		return func(contest *RawCardContest) ([]int, int, int) {
+			ballot, _, err := scoreRCVContest(contest, cands, contestInfo.NumOfRanks, rules)
+			if err != nil {
+				panic(err)
+			}
+			switch {
+			case len(ballot.ranks) > 0:
+				return ballot.ranks[:1], 0, 0
+			case ballot.overvoted:
+				return nil, 0, 1
+			default:
+				return nil, 1, 0
+			}
+		}
+	case contestInfo.VoteFor > 1:
+		return func(contest *RawCardContest) ([]int, int, int) {
+			selected, voteStr, err := scoreVoteForNContest(contest, cands, contestInfo.VoteFor)
+			if err != nil {
+				panic(err)
+			}
+			if voteStr == invalid {
+				return nil, 0, contestInfo.VoteFor
+			}
+			return selected, contestInfo.VoteFor - len(selected), 0
+		}
+	default:
+		return func(contest *RawCardContest) ([]int, int, int) {
+			id, vote, err := scoreContest(contest, cands)
+			if err != nil {
+				panic(err)
+			}
+			switch vote {
+			case abstain:
+				return nil, 1, 0
+			case invalid:
+				return nil, 0, 1
+			default:
+				return []int{id}, 0, 0
+			}
+		}
+	}
+}
+
+// groupedTallies tallies the given contest separately for each group of
+// ballots, as given by group.
+func groupedTallies(b *BallotData, contestID int, rules rcvBallotRules, group func(*Ballot) int) map[int]*contestTally {
+	score := contestVotes(b, contestID, rules)
+	ret := map[int]*contestTally{}
+	b.forEachBallot(func(ballot *Ballot) {
+		for _, card := range ballot.Cards {
+			for _, contest := range card.Contests {
+				if contest.ID != contestID {
+					continue
+				}
+
+				key := group(ballot)
+				tally, ok := ret[key]
+				if !ok {
+					tally = &contestTally{votes: map[int]int{}}
+					ret[key] = tally
+				}
+				votes, under, over := score(contest)
+				tally.ballots++
+				for _, id := range votes {
+					tally.votes[id]++
+				}
+				tally.undervotes += under
+				tally.overvotes += over
+			}
+		}
+	})
+	return ret
+}
+
+// tallyGrid lays out grouped tallies with a row per group, in the order given,
+// and a column per candidate. labels gives the leading columns for each
+// group, under the headings in labelHeaders.
+func tallyGrid(b *BallotData, contestID int, tallies map[int]*contestTally, groups []int,
+	labelHeaders []string, labels func(int) []any,
+) [][]any {
+	names := fullNames(b, contestID)
+	ids := sortedCandidates(names)
+
+	header := map1(func(s string) any { return s }, labelHeaders)
+	header = append(header, "Ballots")
+	for _, id := range ids {
+		header = append(header, names[id])
+	}
+	header = append(header, "Undervotes", "Overvotes")
+
+	ret := [][]any{header}
+	for _, group := range groups {
+		tally, ok := tallies[group]
+		if !ok {
+			tally = &contestTally{}
+		}
+		row := append(labels(group), tally.ballots)
+		for _, id := range ids {
+			row = append(row, tally.votes[id])
+		}
+		ret = append(ret, append(row, tally.undervotes, tally.overvotes))
+	}
+	return ret
+}
+
+// PrecinctPortionResults returns the results of a contest in each precinct
+// portion, including those with no ballots for it. Ballots from precinct
+// portions not in the manifest are listed as "(unknown)".
+func PrecinctPortionResults(b *BallotData, contestID int, rules rcvBallotRules) [][]any {
+	tallies := groupedTallies(b, contestID, rules, func(ballot *Ballot) int {
+		if _, ok := b.PrecinctPortions[ballot.PrecinctPortionID]; ok {
+			return ballot.PrecinctPortionID
+		}
+		return 0
+	})
+	ids := maps.Keys(b.PrecinctPortions)
+	slices.Sort(ids)
+	if _, ok := tallies[0]; ok {
+		ids = append(ids, 0)
+	}
+	return tallyGrid(b, contestID, tallies, ids,
+		[]string{"Precinct Portion", "Precinct Portion ID", "Precinct ID"},
+		func(id int) []any {
+			if id == 0 {
+				return []any{"(unknown)", "", ""}
+			}
+			pp := b.PrecinctPortions[id]
+			precinctID := ""
+			if precinct, ok := b.Precincts[pp.PrecinctID]; ok {
+				precinctID = precinct.ExternalID
+			}
+			return []any{pp.Description, pp.ExternalID, precinctID}
+		})
+}
+
+// PrecinctResults returns the results of a contest in each precinct, rolling
+// up its portions. Ballots from precinct portions not in any known precinct
+// are listed as "(unknown)".
+func PrecinctResults(b *BallotData, contestID int, rules rcvBallotRules) [][]any {
+	tallies := groupedTallies(b, contestID, rules, func(ballot *Ballot) int {
+		if pp, ok := b.PrecinctPortions[ballot.PrecinctPortionID]; ok {
+			if _, ok := b.Precincts[pp.PrecinctID]; ok {
+				return pp.PrecinctID
+			}
+		}
+		return 0
+	})
+	ids := maps.Keys(b.Precincts)
+	slices.Sort(ids)
+	if _, ok := tallies[0]; ok {
+		ids = append(ids, 0)
+	}
+	return tallyGrid(b, contestID, tallies, ids,
+		[]string{"Precinct", "Precinct ID"},
+		func(id int) []any {
+			if id == 0 {
+				return []any{"(unknown)", ""}
+			}
+			return []any{b.Precincts[id].Description, b.Precincts[id].ExternalID}
+		})
+}
+
+// DistrictResults returns the results of a contest in each district of the
+// given type, rolling up the precinct portions in it. Ballots from precinct
+// portions not in any such district are listed as "(none)".
+func DistrictResults(b *BallotData, contestID int, rules rcvBallotRules, districtTypeID string) [][]any {
+	tallies := groupedTallies(b, contestID, rules, func(ballot *Ballot) int {
+		return b.District(ballot.PrecinctPortionID, districtTypeID)
+	})
+	var ids []int
+	for id, district := range b.Districts {
+		if district.DistrictTypeID == districtTypeID {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	if _, ok := tallies[0]; ok {
+		ids = append(ids, 0)
+	}
+	return tallyGrid(b, contestID, tallies, ids,
+		[]string{"District"},
+		func(id int) []any {
+			if id == 0 {
+				return []any{"(none)"}
+			}
+			return []any{b.Districts[id].Description}
+		})
+}
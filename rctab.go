@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// The summary JSON format written by RCTab (the Ranked Choice Voting
+// Resource Center's tabulator), and read by RCVis and similar tools. Vote
+// counts are strings, as RCTab writes them.
+type rctabSummary struct {
+	Config            rctabConfig  `json:"config"`
+	JSONFormatVersion string       `json:"jsonFormatVersion"`
+	Results           []rctabRound `json:"results"`
+	Summary           rctabTotals  `json:"summary"`
+}
+
+type rctabConfig struct {
+	Contest      string `json:"contest"`
+	Date         string `json:"date"`
+	Jurisdiction string `json:"jurisdiction"`
+	Office       string `json:"office"`
+	GeneratedBy  string `json:"generatedBy"`
+}
+
+type rctabRound struct {
+	Round        int                `json:"round"`
+	Tally        map[string]string  `json:"tally"`
+	TallyResults []rctabTallyResult `json:"tallyResults"`
+	Threshold    string             `json:"threshold"`
+}
+
+type rctabTallyResult struct {
+	Elected    string            `json:"elected,omitempty"`
+	Eliminated string            `json:"eliminated,omitempty"`
+	Transfers  map[string]string `json:"transfers"`
+}
+
+type rctabTotals struct {
+	FinalThreshold  string `json:"finalThreshold"`
+	NumCandidates   int    `json:"numCandidates"`
+	NumWinners      int    `json:"numWinners"`
+	TotalNumBallots string `json:"totalNumBallots"`
+	Undervotes      int    `json:"undervotes"`
+}
+
+// rctabJSON converts IRV rounds to RCTab's summary format. RCTab counts both
+// exhausted and overvoted ballots as "exhausted".
+func rctabJSON(description string, ballots []rcvBallot, rounds []irvRoundResults, names map[int]string) ([]byte, error) {
+	out := rctabSummary{
+		Config: rctabConfig{
+			Contest:     description,
+			Office:      description,
+			GeneratedBy: "sfballots",
+		},
+		JSONFormatVersion: "1",
+		Results:           make([]rctabRound, len(rounds)),
+	}
+
+	threshold := func(round irvRoundResults) string {
+		return strconv.Itoa(round.continuing()/2 + 1)
+	}
+	for r, round := range rounds {
+		tally := make(map[string]string, len(round.tallies))
+		for id, votes := range round.tallies {
+			tally[names[id]] = strconv.Itoa(votes)
+		}
+
+		var results []rctabTallyResult
+		if round.winner != 0 {
+			results = append(results, rctabTallyResult{
+				Elected:   names[round.winner],
+				Transfers: map[string]string{},
+			})
+		}
+		for _, id := range round.eliminated {
+			counts := map[string]int{}
+			for to, votes := range round.transfers[id] {
+				name := "exhausted"
+				if to != exhaustedID && to != overvoteID {
+					name = names[to]
+				}
+				counts[name] += votes
+			}
+			transfers := make(map[string]string, len(counts))
+			for name, votes := range counts {
+				transfers[name] = strconv.Itoa(votes)
+			}
+			results = append(results, rctabTallyResult{
+				Eliminated: names[id],
+				Transfers:  transfers,
+			})
+		}
+
+		out.Results[r] = rctabRound{
+			Round:        r + 1,
+			Tally:        tally,
+			TallyResults: results,
+			Threshold:    threshold(round),
+		}
+	}
+
+	for _, ballot := range ballots {
+		if len(ballot.ranks) == 0 && !ballot.overvoted {
+			out.Summary.Undervotes++
+		}
+	}
+	out.Summary.FinalThreshold = threshold(rounds[len(rounds)-1])
+	out.Summary.NumCandidates = len(rounds[0].tallies)
+	out.Summary.NumWinners = 1
+	out.Summary.TotalNumBallots = strconv.Itoa(len(ballots))
+
+	return json.MarshalIndent(out, "", "  ")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Each analysis returns a typed result. Text renders it as we always have;
+// with -format json, we print the results themselves, as a JSON array. The
+// JSON field names are stable: we may add fields, but won't rename or remove
+// them.
+//
+// Candidates are given as CandidateInfo: their ID, their short name (as in
+// the text output), and their full name as on the ballot. Where a result is
+// a string, as in the text output, the candidates it names are also given by
+// ID.
+
+// Result is the result of an analysis.
+type Result interface {
+	// Text renders the result as text, as printed by default.
+	Text() string
+	header() *resultHeader
+}
+
+type resultHeader struct {
+	// plurality, voteForN, rcv, countingGroupShifts, crosstab, grid, or
+	// cards
+	Type string `json:"type"`
+	// set if the result only counts ballots from one counting group
+	CountingGroup *CountingGroupInfo `json:"countingGroup,omitempty"`
+}
+
+func (h *resultHeader) header() *resultHeader { return h }
+
+type CountingGroupInfo struct {
+	ID          int    `json:"id"`
+	Description string `json:"description"`
+}
+
+type CandidateInfo struct {
+	// 0 for Abstain or Invalid, -1 for Exhausted, -2 for Overvote
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	FullName string `json:"fullName"`
+}
+
+type ContestInfo struct {
+	ID          int    `json:"id"` // 0 for ballots read from a BLT or PrefLib file
+	Description string `json:"description"`
+	VoteFor     int    `json:"voteFor,omitempty"`
+	NumRanks    int    `json:"numRanks,omitempty"`
+	// sorted by name
+	Candidates []CandidateInfo `json:"candidates"`
+}
+
+// Tally is a number of ballots with one result: a candidate, several
+// candidates, or Abstain or Invalid.
+type Tally struct {
+	// as in the text output: candidates' names are joined with " + " for a
+	// vote-for-N contest, or " > " for a ranked contest
+	Result string `json:"result"`
+	// the candidates named in Result, in order
+	CandidateIDs []int `json:"candidateIds,omitempty"`
+	Count        int   `json:"count"`
+}
+
+type CandidateCount struct {
+	CandidateInfo
+	Count int `json:"count"`
+}
+
+type CandidateScore struct {
+	CandidateInfo
+	Score float64 `json:"score"`
+}
+
+// candidateNames are the names of the candidates in a contest, short and
+// full, by ID.
+type candidateNames struct {
+	short, full map[int]string
+}
+
+func contestCandidateNames(b *BallotData, contestID int) candidateNames {
+	cands, err := candidates(b, contestID)
+	if err != nil {
+		panic(err)
+	}
+	return candidateNames{cands, fullNames(b, contestID)}
+}
+
+func (c candidateNames) info(id int) CandidateInfo {
+	switch id {
+	case exhaustedID, overvoteID:
+		name := irvName(id, c.short)
+		return CandidateInfo{ID: id, Name: name, FullName: name}
+	default:
+		return CandidateInfo{ID: id, Name: c.short[id], FullName: c.full[id]}
+	}
+}
+
+func (c candidateNames) infos(ids []int) []CandidateInfo {
+	return map1(c.info, ids)
+}
+
+// sorted returns the info for the given candidates, sorted by name.
+func (c candidateNames) sorted(ids []int) []CandidateInfo {
+	return c.infos(sortedCandidates(onlyCandidates(c.short, ids)))
+}
+
+// ranking converts a ranking, with each tier sorted by name.
+func (c candidateNames) ranking(r ranking) [][]CandidateInfo {
+	if r == nil {
+		return nil
+	}
+	return map1(c.sorted, r)
+}
+
+// otherVote is the info for Abstain or Invalid, given in place of a
+// candidate.
+func otherVote(name string) CandidateInfo {
+	return CandidateInfo{Name: name, FullName: name}
+}
+
+// counts converts counts by candidate ID, for every candidate, sorted by
+// name.
+func (c candidateNames) counts(counts map[int]int) []CandidateCount {
+	return map1(func(id int) CandidateCount {
+		return CandidateCount{c.info(id), counts[id]}
+	}, sortedCandidates(c.short))
+}
+
+// scores converts scores by candidate ID, for every candidate, sorted by
+// name.
+func scores[T numeric](c candidateNames, totals map[int]T) []CandidateScore {
+	return map1(func(id int) CandidateScore {
+		return CandidateScore{c.info(id), float64(totals[id])}
+	}, sortedCandidates(c.short))
+}
+
+func (c candidateNames) contest(id int, description string, voteFor, numRanks int) ContestInfo {
+	return ContestInfo{
+		ID:          id,
+		Description: description,
+		VoteFor:     voteFor,
+		NumRanks:    numRanks,
+		Candidates:  c.infos(sortedCandidates(c.short)),
+	}
+}
+
+func contestInfo(b *BallotData, contestID int) ContestInfo {
+	contest := b.Contests[contestID]
+	return contestCandidateNames(b, contestID).contest(
+		contestID, contest.Description, contest.VoteFor, contest.NumOfRanks)
+}
+
+// voteCount is a number of ballots with the same vote: the candidates they
+// vote for, in order, or if none, Abstain or Invalid.
+type voteCount struct {
+	ids   []int
+	other string // if ids is empty
+	count int
+}
+
+// voteCounter counts ballots by their vote, keeping the votes in the order
+// they're first seen.
+type voteCounter struct {
+	index map[string]int
+	votes []voteCount
+}
+
+func (c *voteCounter) add(ids []int, other string) {
+	key := make([]byte, 0, len(other)+4*len(ids))
+	key = append(key, other...)
+	for _, id := range ids {
+		key = strconv.AppendInt(append(key, ','), int64(id), 10)
+	}
+	if i, ok := c.index[string(key)]; ok {
+		c.votes[i].count++
+		return
+	}
+	if c.index == nil {
+		c.index = map[string]int{}
+	}
+	c.index[string(key)] = len(c.votes)
+	c.votes = append(c.votes, voteCount{ids, other, 1})
+}
+
+// tallies converts vote counts, naming the candidates (joined with sep) only
+// for each Tally's Result, in the order formatResults uses.
+func (c candidateNames) tallies(votes []voteCount, sep string) []Tally {
+	ret := map1(func(vote voteCount) Tally {
+		if len(vote.ids) == 0 {
+			return Tally{Result: vote.other, Count: vote.count}
+		}
+		names := map1(func(id int) string { return c.short[id] }, vote.ids)
+		return Tally{Result: strings.Join(names, sep), CandidateIDs: vote.ids, Count: vote.count}
+	}, votes)
+	slices.SortStableFunc(ret, func(x, y Tally) bool { return less(x.Result, y.Result) })
+	return ret
+}
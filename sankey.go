@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strconv"
+
+	"golang.org/x/exp/slices"
+)
+
+// irvName returns the name of a candidate, or pseudo-candidate.
+func irvName(id int, candidates map[int]string) string {
+	switch id {
+	case exhaustedID:
+		return exhausted
+	case overvoteID:
+		return overvoted
+	default:
+		return candidates[id]
+	}
+}
+
+// transferGrid lists the votes transferred after each IRV round, from each
+// eliminated candidate to each candidate who received them (or exhausted).
+func transferGrid(rounds []irvRoundResults, candidates map[int]string) [][]any {
+	ret := [][]any{{"Round", "From", "To", "Votes"}}
+	for r, round := range rounds {
+		for _, from := range round.eliminated {
+			tos := make([]int, 0, len(round.transfers[from]))
+			for to := range round.transfers[from] {
+				tos = append(tos, to)
+			}
+			slices.SortFunc(tos, func(i, j int) bool {
+				return less(irvName(i, candidates), irvName(j, candidates))
+			})
+			for _, to := range tos {
+				ret = append(ret, []any{
+					r + 1, candidates[from], irvName(to, candidates), round.transfers[from][to]})
+			}
+		}
+	}
+	return ret
+}
+
+var sankeyColors = []string{
+	"#4e79a7", "#f28e2b", "#e15759", "#76b7b2", "#59a14f",
+	"#edc948", "#b07aa1", "#ff9da7", "#9c755f", "#bab0ac",
+}
+
+const (
+	sankeyColumnWidth = 220
+	sankeyNodeWidth   = 16
+	sankeyHeight      = 600
+	sankeyGap         = 12
+	sankeyMargin      = 40
+)
+
+// formatSankeyHTML draws the IRV rounds as a Sankey diagram, as a standalone
+// HTML page with an inline SVG: one column per round, with a node for each
+// continuing candidate (and exhausted ballots), and flows for the votes each
+// one keeps or transfers to the next round.
+func formatSankeyHTML(title string, rounds []irvRoundResults, candidates map[int]string) string {
+	// Keep candidates in a consistent order, by first-round votes, with the
+	// pseudo-candidates at the bottom.
+	order := make([]int, 0, len(candidates)+2)
+	for id := range rounds[0].tallies {
+		order = append(order, id)
+	}
+	slices.SortFunc(order, func(i, j int) bool {
+		if rounds[0].tallies[i] != rounds[0].tallies[j] {
+			return rounds[0].tallies[i] > rounds[0].tallies[j]
+		}
+		return candidates[i] < candidates[j]
+	})
+	order = append(order, exhaustedID, overvoteID)
+	color := map[int]string{exhaustedID: "#999999", overvoteID: "#666666"}
+	for i, id := range order[:len(order)-2] {
+		color[id] = sankeyColors[i%len(sankeyColors)]
+	}
+
+	votes := func(round irvRoundResults, id int) int {
+		switch id {
+		case exhaustedID:
+			return round.exhausted
+		case overvoteID:
+			return round.overvotes
+		default:
+			return round.tallies[id]
+		}
+	}
+	present := func(round irvRoundResults, id int) bool {
+		_, ok := round.tallies[id]
+		return ok || votes(round, id) > 0
+	}
+
+	total := 0
+	for _, id := range order {
+		total += votes(rounds[len(rounds)-1], id)
+	}
+	scale := float64(sankeyHeight-len(order)*sankeyGap) / float64(max(total, 1))
+
+	// tops[r][id] is the y coordinate of the top of id's node in round r.
+	tops := make([]map[int]float64, len(rounds))
+	for r, round := range rounds {
+		tops[r] = map[int]float64{}
+		y := float64(sankeyMargin)
+		for _, id := range order {
+			if !present(round, id) {
+				continue
+			}
+			tops[r][id] = y
+			y += float64(votes(round, id))*scale + sankeyGap
+		}
+	}
+
+	width := sankeyMargin*2 + (len(rounds)-1)*sankeyColumnWidth + sankeyNodeWidth + 160
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n",
+		html.EscapeString(title))
+	fmt.Fprintf(&b, "<h1>%s</h1>\n", html.EscapeString(title))
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="12">`+"\n",
+		width, sankeyHeight+2*sankeyMargin)
+
+	// flows
+	for r, round := range rounds[:len(rounds)-1] {
+		next := rounds[r+1]
+		x0 := float64(sankeyMargin+r*sankeyColumnWidth) + sankeyNodeWidth
+		x1 := float64(sankeyMargin + (r+1)*sankeyColumnWidth)
+		// how far down each node's outgoing and incoming flows have gotten
+		out := map[int]float64{}
+		in := map[int]float64{}
+		flow := func(from, to, n int) {
+			if n == 0 {
+				return
+			}
+			h := float64(n) * scale
+			y0 := tops[r][from] + out[from]
+			y1 := tops[r+1][to] + in[to]
+			out[from] += h
+			in[to] += h
+			mid := (x0 + x1) / 2
+			fmt.Fprintf(&b,
+				`<path d="M%.1f,%.1f C%.1f,%.1f %.1f,%.1f %.1f,%.1f L%.1f,%.1f C%.1f,%.1f %.1f,%.1f %.1f,%.1f Z" fill="%s" fill-opacity="0.4"><title>%s → %s: %d</title></path>`+"\n",
+				x0, y0, mid, y0, mid, y1, x1, y1,
+				x1, y1+h, mid, y1+h, mid, y0+h, x0, y0+h,
+				color[from],
+				html.EscapeString(irvName(from, candidates)), html.EscapeString(irvName(to, candidates)), n)
+		}
+		for _, from := range order {
+			if !present(round, from) {
+				continue
+			}
+			if transfers, ok := round.transfers[from]; ok {
+				for _, to := range order {
+					flow(from, to, transfers[to])
+				}
+			} else {
+				// votes carried over; for exhausted ballots, that's
+				// everything that was already exhausted.
+				flow(from, from, min(votes(round, from), votes(next, from)))
+			}
+		}
+	}
+
+	// nodes
+	for r, round := range rounds {
+		x := sankeyMargin + r*sankeyColumnWidth
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-weight="bold">Round %d</text>`+"\n", x, sankeyMargin-16, r+1)
+		for _, id := range order {
+			if !present(round, id) {
+				continue
+			}
+			h := float64(votes(round, id)) * scale
+			fmt.Fprintf(&b, `<rect x="%d" y="%.1f" width="%d" height="%.1f" fill="%s"/>`+"\n",
+				x, tops[r][id], sankeyNodeWidth, max(h, 1), color[id])
+			label := irvName(id, candidates) + " " + strconv.Itoa(votes(round, id))
+			if slices.Contains(round.eliminated, id) {
+				label += " ✗"
+			} else if round.winner == id {
+				label += " ✓"
+			}
+			fmt.Fprintf(&b, `<text x="%d" y="%.1f" dy="0.35em">%s</text>`+"\n",
+				x+sankeyNodeWidth+4, tops[r][id]+h/2, html.EscapeString(label))
+		}
+	}
+	b.WriteString("</svg>\n</body>\n</html>\n")
+	return b.String()
+}
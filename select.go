@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// matchDescriptions finds the IDs whose descriptions match a pattern: an exact
+// ID; otherwise a description equal to the pattern, ignoring case; otherwise
+// those containing it, ignoring case; otherwise those matching it as a
+// case-insensitive regex.
+func matchDescriptions(pattern string, descriptions map[int]string) ([]int, error) {
+	ids := maps.Keys(descriptions)
+	slices.Sort(ids)
+
+	if id, err := strconv.Atoi(strings.TrimSpace(pattern)); err == nil {
+		if _, ok := descriptions[id]; ok {
+			return []int{id}, nil
+		}
+		return nil, nil
+	}
+
+	filter := func(match func(string) bool) []int {
+		var ret []int
+		for _, id := range ids {
+			if match(descriptions[id]) {
+				ret = append(ret, id)
+			}
+		}
+		return ret
+	}
+	if ret := filter(func(d string) bool { return strings.EqualFold(d, pattern) }); len(ret) > 0 {
+		return ret, nil
+	}
+	lower := strings.ToLower(pattern)
+	if ret := filter(func(d string) bool { return strings.Contains(strings.ToLower(d), lower) }); len(ret) > 0 {
+		return ret, nil
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, err
+	}
+	return filter(re.MatchString), nil
+}
+
+// matchOne is matchDescriptions for a pattern that must pick out exactly one
+// ID; what describes the kind of thing, for errors.
+func matchOne(what, pattern string, descriptions map[int]string) (int, error) {
+	ids, err := matchDescriptions(pattern, descriptions)
+	switch {
+	case err != nil:
+		return 0, fmt.Errorf("bad %v pattern %q: %w", what, pattern, err)
+	case len(ids) == 0:
+		return 0, fmt.Errorf("no %v matches %q", what, pattern)
+	case len(ids) > 1:
+		var buf strings.Builder
+		fmt.Fprintf(&buf, "%q matches %v %vs:", pattern, len(ids), what)
+		for _, id := range ids {
+			fmt.Fprintf(&buf, "\n  %v %v", id, descriptions[id])
+		}
+		return 0, fmt.Errorf("%s", buf.String())
+	}
+	return ids[0], nil
+}
+
+// SelectContests finds the contests given by each pattern (see
+// matchDescriptions), which must each match exactly one.
+func SelectContests(b *BallotData, patterns []string) ([]int, error) {
+	descriptions := make(map[int]string, len(b.Contests))
+	for id, contest := range b.Contests {
+		descriptions[id] = contest.Description
+	}
+	ids := make([]int, len(patterns))
+	for i, pattern := range patterns {
+		var err error
+		ids[i], err = matchOne("contest", pattern, descriptions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// DistrictContests finds the district given by the pattern (see
+// matchDescriptions), and returns the contests in it, in order.
+func DistrictContests(b *BallotData, pattern string) ([]int, error) {
+	descriptions := make(map[int]string, len(b.Districts))
+	for id, district := range b.Districts {
+		descriptions[id] = district.Description
+	}
+	districtID, err := matchOne("district", pattern, descriptions)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for id, contest := range b.Contests {
+		if contest.DistrictID == districtID {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
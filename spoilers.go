@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// withdraw returns the ballots and candidates as if the given candidates had
+// never run: they are removed from every ranking, and the voter's later
+// choices move up.
+func withdraw(ballots []rcvBallot, candidates map[int]string, withdrawn []int) ([]rcvBallot, map[int]string) {
+	out := make([]rcvBallot, len(ballots))
+	for i, ballot := range ballots {
+		out[i].overvoted = ballot.overvoted
+		for _, id := range ballot.ranks {
+			if !slices.Contains(withdrawn, id) {
+				out[i].ranks = append(out[i].ranks, id)
+			}
+		}
+	}
+	remaining := maps.Clone(candidates)
+	for _, id := range withdrawn {
+		delete(remaining, id)
+	}
+	return out, remaining
+}
+
+var rcvMethods = []string{"IRV", "Schulze", "Borda", "Dowdall"}
+
+// positionalWinners returns the candidates with the highest total.
+func positionalWinners[T numeric](totals map[int]T, candidates map[int]string) []int {
+	var best T
+	var winners []int
+	for _, id := range sortedCandidates(candidates) {
+		total := totals[id]
+		switch {
+		case len(winners) == 0 || total > best:
+			best, winners = total, []int{id}
+		case total == best:
+			winners = append(winners, id)
+		}
+	}
+	return winners
+}
+
+// rcvWinners returns the winners under each of rcvMethods: one, or more if
+// they tie, sorted by name.
+func rcvWinners(ballots []rcvBallot, candidates map[int]string, numRanks int, opts rcvOptions) [][]int {
+	var irvWinners []int
+	if irv := runIRV(ballots, candidates, opts.irv); len(irv) > 0 {
+		irvWinners = []int{irv[len(irv)-1].winner}
+	}
+	schulze, _ := runSchulze(pairwisePreferences(rankings(ballots), candidates))
+	var schulzeWinners []int
+	if len(schulze) > 0 {
+		schulzeWinners = sortedCandidates(onlyCandidates(candidates, schulze[0]))
+	}
+	return [][]int{
+		irvWinners,
+		schulzeWinners,
+		positionalWinners(runPositional(rankings(ballots), borda(numRanks)), candidates),
+		positionalWinners(runPositional(rankings(ballots), dowdall), candidates),
+	}
+}
+
+// SpoilerScenario is who would have won under each of rcvMethods with some
+// candidates withdrawn.
+type SpoilerScenario struct {
+	Withdrawn []CandidateInfo `json:"withdrawn"` // empty for the actual result
+	// by method; more than one if they tie
+	Winners map[string][]CandidateInfo `json:"winners"`
+	// the methods whose winners differ from the actual ones
+	Changed []string `json:"changed,omitempty"`
+}
+
+// spoilerScenarios reruns each of rcvMethods with each candidate withdrawn in
+// turn, as well as with the given set withdrawn together. The first scenario
+// is the actual result, with none withdrawn. The set is skipped unless they're
+// all candidates here: with several contests, they may be another's.
+func spoilerScenarios(ballots []rcvBallot, names candidateNames, numRanks int, opts rcvOptions) []SpoilerScenario {
+	actual := rcvWinners(ballots, names.short, numRanks, opts)
+	scenario := func(withdrawn []int, winners [][]int) SpoilerScenario {
+		ret := SpoilerScenario{
+			Withdrawn: names.infos(withdrawn),
+			Winners:   make(map[string][]CandidateInfo, len(rcvMethods)),
+		}
+		for i, method := range rcvMethods {
+			ret.Winners[method] = names.infos(winners[i])
+			if !slices.Equal(winners[i], actual[i]) {
+				ret.Changed = append(ret.Changed, method)
+			}
+		}
+		return ret
+	}
+	ret := []SpoilerScenario{scenario(nil, actual)}
+
+	var withdrawals [][]int
+	if opts.spoilers && len(names.short) > 1 {
+		for _, id := range sortedCandidates(names.short) {
+			withdrawals = append(withdrawals, []int{id})
+		}
+	}
+	if ok, err := canWithdraw(opts.withdraw, names.short); len(opts.withdraw) > 0 && ok && err == nil {
+		withdrawals = append(withdrawals, opts.withdraw)
+	}
+	for _, withdrawn := range withdrawals {
+		remainingBallots, remaining := withdraw(ballots, names.short, withdrawn)
+		ret = append(ret, scenario(withdrawn, rcvWinners(remainingBallots, remaining, numRanks, opts)))
+	}
+	return ret
+}
+
+// canWithdraw reports whether the given candidates are all candidates in a
+// contest, and if so, returns an error if they're every one of them.
+func canWithdraw(withdrawn []int, candidates map[int]string) (bool, error) {
+	for _, id := range withdrawn {
+		if _, ok := candidates[id]; !ok {
+			return false, nil
+		}
+	}
+	if len(onlyCandidates(candidates, withdrawn)) == len(candidates) {
+		return true, errors.New("can't withdraw every candidate")
+	}
+	return true, nil
+}
+
+// spoilerTable lays out the scenarios, with ties shown as "A = B", and marks
+// with a "*" each winner that differs from the actual one.
+func spoilerTable(scenarios []SpoilerScenario) [][]string {
+	names := func(cands []CandidateInfo, sep string) string {
+		return strings.Join(map1(func(c CandidateInfo) string { return c.Name }, cands), sep)
+	}
+	ret := [][]string{append([]string{"Withdrawn"}, rcvMethods...)}
+	for _, s := range scenarios {
+		row := []string{ternary(len(s.Withdrawn) == 0, "(none)", names(s.Withdrawn, ", "))}
+		for _, method := range rcvMethods {
+			row = append(row, names(s.Winners[method], " = ")+ternary(slices.Contains(s.Changed, method), "*", ""))
+		}
+		ret = append(ret, row)
+	}
+	return ret
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+type stvQuota int
+
+const (
+	quotaDroop stvQuota = iota
+	quotaHare
+)
+
+func (q stvQuota) String() string {
+	switch q {
+	case quotaDroop:
+		return "droop"
+	case quotaHare:
+		return "hare"
+	default:
+		return "stvQuota(" + strconv.Itoa(int(q)) + ")"
+	}
+}
+
+type stvTransfer int
+
+const (
+	// Weighted Inclusive Gregory: transfer every ballot held by an elected
+	// candidate, at a weight reduced so the total is their surplus.
+	transferWIGM stvTransfer = iota
+	// Meek: each elected candidate keeps a fraction of every ballot that
+	// reaches them, iterated so they keep exactly a quota.
+	transferMeek
+)
+
+func (t stvTransfer) String() string {
+	switch t {
+	case transferWIGM:
+		return "wigm"
+	case transferMeek:
+		return "meek"
+	default:
+		return "stvTransfer(" + strconv.Itoa(int(t)) + ")"
+	}
+}
+
+func parseSTVOptions(quota, transfer string) (stvQuota, stvTransfer, error) {
+	var q stvQuota
+	switch quota {
+	case quotaDroop.String():
+		q = quotaDroop
+	case quotaHare.String():
+		q = quotaHare
+	default:
+		return 0, 0, fmt.Errorf("unknown quota %q", quota)
+	}
+	switch transfer {
+	case transferWIGM.String():
+		return q, transferWIGM, nil
+	case transferMeek.String():
+		return q, transferMeek, nil
+	default:
+		return 0, 0, fmt.Errorf("unknown surplus transfer %q", transfer)
+	}
+}
+
+type stvOptions struct {
+	seats    int // 0 to skip STV
+	quota    stvQuota
+	transfer stvTransfer
+}
+
+type stvRoundResults struct {
+	tallies    map[int]float64 // candidate ID -> votes, for all but excluded candidates
+	exhausted  float64
+	quota      float64
+	elected    []int // newly elected this round
+	eliminated []int
+	surplusOf  int // candidate whose surplus is transferred after this round, or 0
+}
+
+// stvBallot is a group of identical rankings.
+type stvBallot struct {
+	ranks  []int
+	weight float64
+	pos    int // WIGM only: index in ranks of the candidate holding the ballot
+}
+
+func groupRankings(ranks [][]int) []*stvBallot {
+	groups := map[string]*stvBallot{}
+	var ret []*stvBallot
+	for _, ranking := range ranks {
+		if len(ranking) == 0 {
+			continue
+		}
+		key := fmt.Sprint(ranking)
+		if g, ok := groups[key]; ok {
+			g.weight++
+			continue
+		}
+		g := &stvBallot{ranks: ranking, weight: 1}
+		groups[key] = g
+		ret = append(ret, g)
+	}
+	return ret
+}
+
+func (o stvOptions) quotaFor(votes float64) float64 {
+	switch o.quota {
+	case quotaHare:
+		return votes / float64(o.seats)
+	default:
+		if o.transfer == transferMeek {
+			// Meek uses an exact (fractional) Droop quota.
+			return votes / float64(o.seats+1)
+		}
+		return math.Floor(votes/float64(o.seats+1)) + 1
+	}
+}
+
+type stvStatus int
+
+const (
+	hopeful stvStatus = iota
+	elected
+	excluded
+)
+
+// runSTV tabulates the weighted ballots by STV; it doesn't modify them.
+func runSTV(weighted []*stvBallot, candidates map[int]string, opts stvOptions) ([]stvRoundResults, error) {
+	if opts.seats > len(candidates) {
+		return nil, fmt.Errorf("can't fill %v STV seats with %v candidates", opts.seats, len(candidates))
+	}
+	ballots := make([]*stvBallot, 0, len(weighted))
+	for _, ballot := range weighted {
+		if len(ballot.ranks) > 0 && ballot.weight > 0 {
+			ballots = append(ballots, &stvBallot{ranks: ballot.ranks, weight: ballot.weight})
+		}
+	}
+	total := 0.0
+	for _, ballot := range ballots {
+		total += ballot.weight
+	}
+
+	ids := maps.Keys(candidates)
+	slices.Sort(ids)
+	status := make(map[int]stvStatus, len(ids))
+	var results []stvRoundResults
+	nElected := 0
+
+	// lowest returns the hopeful candidate with the fewest votes, breaking
+	// ties by prior rounds and then by ID.
+	lowest := func(tallies map[int]float64) int {
+		ret := -1
+		for _, id := range ids {
+			if status[id] != hopeful {
+				continue
+			}
+			if ret == -1 {
+				ret = id
+				continue
+			}
+			if tallies[id] != tallies[ret] {
+				if tallies[id] < tallies[ret] {
+					ret = id
+				}
+				continue
+			}
+			for i := len(results) - 1; i >= 0; i-- {
+				prior := results[i].tallies
+				if prior[id] != prior[ret] {
+					if prior[id] < prior[ret] {
+						ret = id
+					}
+					break
+				}
+			}
+		}
+		return ret
+	}
+
+	// electOrExclude does the part of each round common to both methods:
+	// elect any hopeful candidates over quota, or, if there are none (and
+	// canExclude), eliminate the lowest. It returns whether all seats are
+	// filled.
+	electOrExclude := func(round *stvRoundResults, canExclude bool) bool {
+		var over []int
+		for _, id := range ids {
+			if status[id] == hopeful && round.tallies[id] >= round.quota {
+				over = append(over, id)
+			}
+		}
+		slices.SortStableFunc(over, func(c1, c2 int) bool { return round.tallies[c1] > round.tallies[c2] })
+		nHopeful := 0
+		for _, id := range ids {
+			if status[id] == hopeful {
+				nHopeful++
+			}
+		}
+		if nHopeful <= opts.seats-nElected {
+			// everyone left is elected, those over quota first
+			for _, id := range ids {
+				if status[id] == hopeful && !slices.Contains(over, id) {
+					over = append(over, id)
+				}
+			}
+			for _, id := range over {
+				status[id] = elected
+				round.elected = append(round.elected, id)
+			}
+			nElected += len(over)
+			return true
+		}
+		for _, id := range over {
+			if nElected < opts.seats {
+				status[id] = elected
+				round.elected = append(round.elected, id)
+				nElected++
+			}
+		}
+		if nElected == opts.seats {
+			return true
+		}
+		if len(over) == 0 && canExclude {
+			loser := lowest(round.tallies)
+			status[loser] = excluded
+			round.eliminated = []int{loser}
+		}
+		return false
+	}
+
+	switch opts.transfer {
+	case transferMeek:
+		keep := make(map[int]float64, len(ids))
+		for _, id := range ids {
+			keep[id] = 1
+		}
+		for {
+			round := stvRoundResults{}
+			for iter := 0; iter < 1000; iter++ {
+				round.tallies = make(map[int]float64, len(ids))
+				round.exhausted = 0
+				for _, ballot := range ballots {
+					w := ballot.weight
+					for _, id := range ballot.ranks {
+						if status[id] == excluded {
+							continue
+						}
+						round.tallies[id] += w * keep[id]
+						w *= 1 - keep[id]
+						if w <= 0 {
+							break
+						}
+					}
+					round.exhausted += w
+				}
+				round.quota = opts.quotaFor(total - round.exhausted)
+
+				converged := true
+				for _, id := range ids {
+					if status[id] != elected {
+						continue
+					}
+					if math.Abs(round.tallies[id]-round.quota) > 1e-6*round.quota {
+						converged = false
+					}
+					keep[id] *= round.quota / round.tallies[id]
+				}
+				if converged {
+					break
+				}
+			}
+			for _, id := range ids {
+				if status[id] == excluded {
+					delete(round.tallies, id)
+				}
+			}
+
+			done := electOrExclude(&round, true)
+			for _, id := range round.eliminated {
+				keep[id] = 0
+			}
+			results = append(results, round)
+			if done {
+				return results, nil
+			}
+		}
+
+	default:
+		kept := map[int]float64{} // elected candidate ID -> votes kept
+		transferred := map[int]bool{}
+		for {
+			round := stvRoundResults{
+				tallies: make(map[int]float64, len(ids)),
+				quota:   opts.quotaFor(total),
+			}
+			for id, votes := range kept {
+				round.tallies[id] = votes
+			}
+			for _, id := range ids {
+				if status[id] == hopeful {
+					round.tallies[id] = 0
+				}
+			}
+			for _, ballot := range ballots {
+				if ballot.pos < len(ballot.ranks) && !transferred[ballot.ranks[ballot.pos]] {
+					round.tallies[ballot.ranks[ballot.pos]] += ballot.weight
+				}
+			}
+			counted := sum(maps.Values(round.tallies))
+			round.exhausted = total - counted
+
+			// Surpluses are transferred before anyone is eliminated.
+			pending := false
+			for _, id := range ids {
+				if status[id] == elected && !transferred[id] {
+					pending = true
+				}
+			}
+			if electOrExclude(&round, !pending) {
+				return append(results, round), nil
+			}
+
+			// Transfer the largest surplus, if there is one; otherwise, the
+			// eliminated candidate's ballots.
+			from, factor := 0, 1.0
+			for _, id := range ids {
+				if status[id] == elected && !transferred[id] &&
+					(from == 0 || round.tallies[id] > round.tallies[from]) {
+					from = id
+				}
+			}
+			if from != 0 {
+				factor = max(round.tallies[from]-round.quota, 0) / round.tallies[from]
+				kept[from] = round.quota
+				transferred[from] = true
+				round.surplusOf = from
+			} else if len(round.eliminated) > 0 {
+				from = round.eliminated[0]
+			}
+			results = append(results, round)
+
+			for _, ballot := range ballots {
+				if ballot.pos >= len(ballot.ranks) || ballot.ranks[ballot.pos] != from {
+					continue
+				}
+				ballot.weight *= factor
+				for ballot.pos < len(ballot.ranks) && status[ballot.ranks[ballot.pos]] != hopeful {
+					ballot.pos++
+				}
+			}
+		}
+	}
+}
+
+// stvTable lays out STV rounds with a row per candidate, and for each round a
+// column of votes and of change since the previous round.
+func stvTable(rounds []stvRoundResults, candidates map[int]string) [][]string {
+	ids := maps.Keys(candidates)
+	slices.SortFunc(ids, func(i, j int) bool { return less(candidates[i], candidates[j]) })
+
+	cell := func(votes float64) string { return strconv.FormatFloat(votes, 'f', 2, 64) }
+	diff := func(votes float64) string {
+		if votes == 0 {
+			return ""
+		}
+		return ternary(votes > 0, "+", "") + cell(votes)
+	}
+
+	ret := make([][]string, len(ids)+4)
+	ret[0] = []string{""}
+	for i, id := range ids {
+		ret[i+1] = []string{candidates[id]}
+	}
+	n := len(ids)
+	ret[n+1] = []string{exhausted}
+	ret[n+2] = []string{"Quota"}
+	ret[n+3] = []string{"Action"}
+
+	for r, round := range rounds {
+		ret[0] = append(ret[0], fmt.Sprintf("Round %v", r+1), "")
+		for i, id := range ids {
+			votes, ok := round.tallies[id]
+			if !ok {
+				ret[i+1] = append(ret[i+1], "", "")
+				continue
+			}
+			change := votes
+			if r > 0 {
+				change -= rounds[r-1].tallies[id]
+			}
+			ret[i+1] = append(ret[i+1], cell(votes), ternary(r > 0, diff(change), ""))
+		}
+		change := round.exhausted
+		if r > 0 {
+			change -= rounds[r-1].exhausted
+		}
+		ret[n+1] = append(ret[n+1], cell(round.exhausted), ternary(r > 0, diff(change), ""))
+		ret[n+2] = append(ret[n+2], cell(round.quota), "")
+
+		var actions []string
+		for _, id := range round.elected {
+			actions = append(actions, "elect "+candidates[id])
+		}
+		for _, id := range round.eliminated {
+			actions = append(actions, "eliminate "+candidates[id])
+		}
+		if round.surplusOf != 0 {
+			actions = append(actions, "transfer "+candidates[round.surplusOf]+" surplus")
+		}
+		ret[n+3] = append(ret[n+3], strings.Join(actions, "; "), "")
+	}
+	return ret
+}
+
+// STVResult is an STV tabulation.
+type STVResult struct {
+	Seats    int             `json:"seats"`
+	Quota    string          `json:"quota"`    // droop or hare
+	Transfer string          `json:"transfer"` // wigm or meek
+	Rounds   []STVRound      `json:"rounds"`
+	Elected  []CandidateInfo `json:"elected"` // in order of election
+}
+
+type STVRound struct {
+	// votes for each candidate not yet excluded
+	Tallies    []CandidateScore `json:"tallies"`
+	Exhausted  float64          `json:"exhausted"`
+	Quota      float64          `json:"quota"`
+	Elected    []CandidateInfo  `json:"elected,omitempty"`
+	Eliminated []CandidateInfo  `json:"eliminated,omitempty"`
+	// the candidate whose surplus is transferred after this round
+	SurplusOf *CandidateInfo `json:"surplusOf,omitempty"`
+}
+
+func stvResult(rounds []stvRoundResults, opts stvOptions, names candidateNames) *STVResult {
+	ret := &STVResult{
+		Seats:    opts.seats,
+		Quota:    opts.quota.String(),
+		Transfer: opts.transfer.String(),
+		Elected:  []CandidateInfo{},
+	}
+	for _, round := range rounds {
+		r := STVRound{
+			Exhausted:  round.exhausted,
+			Quota:      round.quota,
+			Elected:    names.infos(round.elected),
+			Eliminated: names.infos(round.eliminated),
+		}
+		for _, id := range sortedCandidates(names.short) {
+			if votes, ok := round.tallies[id]; ok {
+				r.Tallies = append(r.Tallies, CandidateScore{names.info(id), votes})
+			}
+		}
+		if round.surplusOf != 0 {
+			surplusOf := names.info(round.surplusOf)
+			r.SurplusOf = &surplusOf
+		}
+		ret.Elected = append(ret.Elected, r.Elected...)
+		ret.Rounds = append(ret.Rounds, r)
+	}
+	return ret
+}
@@ -1,23 +1,140 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type BallotData struct {
 	Raw                  *RawBallotData
 	Candidates           map[int]*RawCandidate
 	Contests             map[int]*RawContest
 	CandidatesByContest  map[int][]*RawCandidate
-	Cards                []*RawCard
+	Ballots              []*Ballot
+	Precincts            map[int]*RawPrecinct
+	PrecinctPortions     map[int]*RawPrecinctPortion
 	PrecinctPortionNames map[int]string
+	CountingGroups       map[int]*RawCountingGroup
+	Districts            map[int]*RawDistrict
+	DistrictTypes        map[string]*RawDistrictType
+	// precinct portion ID -> IDs of the districts it's in, one of each type
+	PrecinctPortionDistricts map[int][]int
+
+	// if set, Ballots is empty, and EachBallot reads the ballots from here
+	// instead
+	stream func(visit func(*Ballot) error) error
+	export *Export // if streaming, to close
+
+	// contest ID -> its scored votes, as needed; see columns.go
+	columns    map[int]*contestColumn
+	rcvColumns map[rcvColumnKey]*rcvColumn
+	// the counting groups with any ballots, once needed; see countingGroups
+	countingGroupIDs []int
+}
+
+// Ballot is a single voter's ballot: all the cards scanned in one session.
+type Ballot struct {
+	TabulatorID       int
+	BatchID           int
+	RecordID          string
+	BallotTypeID      int
+	PrecinctPortionID int
+	CountingGroupID   int
+	Cards             []*RawCard
+}
+
+type ballotKey struct {
+	tabulatorID, batchID int
+	recordID             string
+}
+
+func sessionBallotKey(session *RawSession) ballotKey {
+	// RecordID is an int in older exports and a string in newer ones.
+	return ballotKey{
+		tabulatorID: session.TabulatorID,
+		batchID:     session.BatchID,
+		recordID:    strings.Trim(string(session.RecordID), `"`),
+	}
+}
+
+// currentSession returns the session as adjudicated, if it was.
+func currentSession(session *RawSession) RawSessionOriginal {
+	if session.Modified.IsCurrent {
+		return session.Modified
+	}
+	return session.Original
+}
+
+func newBallot(session *RawSession) *Ballot {
+	key := sessionBallotKey(session)
+	current := currentSession(session)
+	return &Ballot{
+		TabulatorID:       key.tabulatorID,
+		BatchID:           key.batchID,
+		RecordID:          key.recordID,
+		BallotTypeID:      current.BallotTypeID,
+		PrecinctPortionID: current.PrecinctPortionID,
+		CountingGroupID:   session.CountingGroupID,
+		Cards:             current.Cards,
+	}
 }
 
 func BuildBallotData(in *RawBallotData) (*BallotData, error) {
+	out := newBallotData(in)
+	for _, cvr := range in.CVRs {
+		for _, session := range cvr.Sessions {
+			out.Ballots = append(out.Ballots, newBallot(session))
+		}
+	}
+	return out, nil
+}
+
+// StreamBallotData loads the manifests of a CVR export, and reads the ballots
+// from it each time they're needed, one at a time, so that an analysis that
+// makes one pass over the ballots needs little more memory than its results.
+func StreamBallotData(dirOrZip string) (*BallotData, error) {
+	export, err := OpenExport(dirOrZip)
+	if err != nil {
+		return nil, err
+	}
+	in, err := export.LoadManifests()
+	if err != nil {
+		export.Close()
+		return nil, err
+	}
+	out := newBallotData(in)
+	out.export = export
+	out.stream = func(visit func(*Ballot) error) error {
+		return export.StreamSessions(func(session *RawSession) error {
+			return visit(newBallot(session))
+		})
+	}
+	return out, nil
+}
+
+// Close closes the export, if streaming from one.
+func (b *BallotData) Close() error {
+	if b.export == nil {
+		return nil
+	}
+	return b.export.Close()
+}
+
+// newBallotData indexes the manifests.
+func newBallotData(in *RawBallotData) *BallotData {
 	out := BallotData{
 		Raw:                  in,
 		Candidates:           map[int]*RawCandidate{},
 		Contests:             map[int]*RawContest{},
 		CandidatesByContest:  map[int][]*RawCandidate{},
+		Precincts:            map[int]*RawPrecinct{},
+		PrecinctPortions:     map[int]*RawPrecinctPortion{},
 		PrecinctPortionNames: map[int]string{},
+		CountingGroups:       map[int]*RawCountingGroup{},
+		Districts:            map[int]*RawDistrict{},
+		DistrictTypes:        map[string]*RawDistrictType{},
+
+		PrecinctPortionDistricts: map[int][]int{},
 	}
 	for _, cand := range in.Candidates {
 		out.Candidates[cand.ID] = cand
@@ -27,22 +144,107 @@ func BuildBallotData(in *RawBallotData) (*BallotData, error) {
 	for _, cont := range in.Contests {
 		out.Contests[cont.ID] = cont
 	}
-	for _, cvr := range in.CVRs {
-		for _, session := range cvr.Sessions {
-			if session.Modified.IsCurrent {
-				out.Cards = append(out.Cards, session.Modified.Cards...)
-			} else {
-				out.Cards = append(out.Cards, session.Original.Cards...)
-			}
-		}
+	for _, p := range in.Precincts {
+		out.Precincts[p.ID] = p
 	}
 	for _, pp := range in.PrecinctPortions {
+		out.PrecinctPortions[pp.ID] = pp
 		out.PrecinctPortionNames[pp.ID] = pp.Description
 	}
-	return &out, nil
+	for _, cg := range in.CountingGroups {
+		out.CountingGroups[cg.ID] = cg
+	}
+	for _, d := range in.Districts {
+		out.Districts[d.ID] = d
+	}
+	for _, dt := range in.DistrictTypes {
+		out.DistrictTypes[dt.ID] = dt
+	}
+	for _, dpp := range in.DistrictsAndPrecinctPortions {
+		out.PrecinctPortionDistricts[dpp.PrecinctPortionID] = append(
+			out.PrecinctPortionDistricts[dpp.PrecinctPortionID], dpp.DistrictID)
+	}
+	return &out
+}
+
+// EachBallot calls visit with each ballot, in order. It stops at the first
+// error from visit or from reading the ballots, and returns it.
+func (b *BallotData) EachBallot(visit func(*Ballot) error) error {
+	if b.stream != nil {
+		return b.stream(visit)
+	}
+	for _, ballot := range b.Ballots {
+		err := visit(ballot)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachBallot is EachBallot, for analyses, which panic if the ballots
+// can't be read.
+func (b *BallotData) forEachBallot(visit func(*Ballot)) {
+	err := b.EachBallot(func(ballot *Ballot) error {
+		visit(ballot)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Filter returns a view of the data with only the ballots for which keep
+// returns true.
+func (b *BallotData) Filter(keep func(*Ballot) bool) *BallotData {
+	out := *b
+	out.columns, out.rcvColumns, out.countingGroupIDs = nil, nil, nil
+	if b.stream != nil {
+		out.stream = func(visit func(*Ballot) error) error {
+			return b.stream(func(ballot *Ballot) error {
+				if keep(ballot) {
+					return visit(ballot)
+				}
+				return nil
+			})
+		}
+		return &out
+	}
+	out.Ballots = nil
+	for _, ballot := range b.Ballots {
+		if keep(ballot) {
+			out.Ballots = append(out.Ballots, ballot)
+		}
+	}
+	return &out
+}
+
+// DistrictType finds a district type by ID or description, ignoring case.
+func (b *BallotData) DistrictType(name string) (*RawDistrictType, error) {
+	for _, dt := range b.DistrictTypes {
+		if strings.EqualFold(dt.ID, name) || strings.EqualFold(dt.Description, name) {
+			return dt, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown district type %q", name)
+}
+
+// District returns the ID of the district of the given type that the
+// precinct portion is in, or 0 if it isn't in one.
+func (b *BallotData) District(precinctPortionID int, districtTypeID string) int {
+	for _, id := range b.PrecinctPortionDistricts[precinctPortionID] {
+		if b.Districts[id].DistrictTypeID == districtTypeID {
+			return id
+		}
+	}
+	return 0
 }
 
 func (b *BallotData) String() string {
-	return fmt.Sprintf("<ballot data, %v candidates in %v contests, %v cards>",
-		len(b.Candidates), len(b.Contests), len(b.Cards))
+	if b.stream != nil {
+		return fmt.Sprintf("<ballot data, %v candidates in %v contests, streaming from %v>",
+			len(b.Candidates), len(b.Contests), b.export.name)
+	}
+	return fmt.Sprintf("<ballot data, %v candidates in %v contests, %v ballots>",
+		len(b.Candidates), len(b.Contests), len(b.Ballots))
 }